@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// accessLogEntry describes a completed client request. Custom access log
+// templates are executed against it, e.g. "{{.RemoteAddr}} {{.Outcome}}".
+type accessLogEntry struct {
+	Time       time.Time     `json:"time"`
+	RequestID  string        `json:"request_id"`
+	RemoteAddr string        `json:"remote_addr"`
+	User       string        `json:"user,omitempty"`
+	Method     string        `json:"method"`
+	URI        string        `json:"uri"`
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	BytesSent  int64         `json:"bytes_sent"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	Duration   time.Duration `json:"duration_ns"`
+	Route      string        `json:"route"`
+	Attempts   int64         `json:"upstream_attempts"`
+	Resumes    int64         `json:"resumes"`
+	Discarded  int64         `json:"bytes_discarded"`
+	Outcome    string        `json:"outcome"`
+}
+
+// Predefined access log formats. "proxy" is the combined format followed by
+// the proxy-specific fields.
+var accessLogTemplates = map[string]string{
+	"common":   `{{.RemoteHost}} - {{dash .User}} [{{.CLFTime}}] "{{.Method}} {{.URI}} {{.Proto}}" {{.Status}} {{.CLFBytes}}`,
+	"combined": `{{.RemoteHost}} - {{dash .User}} [{{.CLFTime}}] "{{.Method}} {{.URI}} {{.Proto}}" {{.Status}} {{.CLFBytes}} "{{dash .Referer}}" "{{dash .UserAgent}}"`,
+	"proxy": `{{.RemoteHost}} - {{dash .User}} [{{.CLFTime}}] "{{.Method}} {{.URI}} {{.Proto}}" {{.Status}} {{.CLFBytes}} "{{dash .Referer}}" "{{dash .UserAgent}}"` +
+		` rid={{.RequestID}} route={{.Route}} attempts={{.Attempts}} resumes={{.Resumes}} discarded={{.Discarded}} outcome={{.Outcome}} duration={{.Duration.Seconds}}`,
+}
+
+// RemoteHost returns the client address without the port.
+func (e *accessLogEntry) RemoteHost() string {
+	if i := strings.LastIndex(e.RemoteAddr, ":"); i >= 0 {
+		return strings.Trim(e.RemoteAddr[:i], "[]")
+	}
+	return e.RemoteAddr
+}
+
+// CLFTime returns the time in the Common Log Format layout.
+func (e *accessLogEntry) CLFTime() string {
+	return e.Time.Format("02/Jan/2006:15:04:05 -0700")
+}
+
+// CLFBytes returns the bytes sent, or "-" if there were none.
+func (e *accessLogEntry) CLFBytes() string {
+	if e.BytesSent == 0 {
+		return "-"
+	}
+	return fmt.Sprint(e.BytesSent)
+}
+
+// accessLog writes one line per completed client request.
+type accessLog struct {
+	mu       sync.Mutex
+	w        io.Writer
+	template *template.Template // nil for JSON
+}
+
+// newAccessLog opens path ("-" for stdout) and prepares format, which is
+// "common", "combined", "proxy", "json" or a text/template.
+func newAccessLog(path, format string) (*accessLog, error) {
+	l := &accessLog{}
+	if format != "json" {
+		text, ok := accessLogTemplates[format]
+		if !ok {
+			text = format
+		}
+		funcs := template.FuncMap{"dash": func(s string) string {
+			if s == "" {
+				return "-"
+			}
+			return s
+		}}
+		tmpl, err := template.New("accesslog").Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log format: %v", err)
+		}
+		l.template = tmpl
+	}
+
+	if path == "-" {
+		l.w = os.Stdout
+	} else {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open access log: %v", err)
+		}
+		l.w = file
+	}
+	return l, nil
+}
+
+// log writes the entry for r, whose transfer t has finished with err.
+func (l *accessLog) log(r *http.Request, t *transfer, err error) {
+	if l == nil {
+		return
+	}
+	entry := &accessLogEntry{
+		Time:       t.started,
+		RequestID:  t.requestID,
+		RemoteAddr: r.RemoteAddr,
+		User:       t.identity,
+		Method:     r.Method,
+		URI:        redactQuery(r.RequestURI), // The query may hold a signature
+		Proto:      r.Proto,
+		Status:     int(t.status.Load()),
+		BytesSent:  t.bytesSent.Load(),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Duration:   time.Since(t.started),
+		Route:      t.route,
+		Attempts:   t.attempts.Load(),
+		Resumes:    t.resumes.Load(),
+		Discarded:  t.discarded.Load(),
+		Outcome:    t.getOutcome(err),
+	}
+
+	var line bytes.Buffer
+	if l.template == nil {
+		json.NewEncoder(&line).Encode(entry)
+	} else {
+		if err := l.template.Execute(&line, entry); err != nil {
+			loggerFrom(r.Context()).Error("Unable to format access log entry", "error", err)
+			return
+		}
+		line.WriteByte('\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line.Bytes())
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// adminTokenEnv holds the admin token if -adminToken is not given, keeping
+// it out of the process list.
+const adminTokenEnv = "RESILIENTPROXY_ADMIN_TOKEN"
+
+// transferInfo describes an active transfer in the admin API.
+type transferInfo struct {
+	ID          uint64        `json:"id"`
+	RequestID   string        `json:"request_id"`
+	Client      string        `json:"client"`
+	Path        string        `json:"path"`
+	Route       string        `json:"route"`
+	Identity    string        `json:"identity,omitempty"`
+	UpstreamURL string        `json:"upstream_url,omitempty"`
+	Started     time.Time     `json:"started"`
+	Duration    time.Duration `json:"duration_ns"`
+	Status      int           `json:"status,omitempty"`
+	BytesSent   int64         `json:"bytes_sent"`
+	Attempt     int64         `json:"attempt"`
+	Resumes     int64         `json:"resumes"`
+	Discarded   int64         `json:"bytes_discarded"`
+	LastError   string        `json:"last_error,omitempty"`
+	ETag        string        `json:"etag,omitempty"`
+}
+
+func (t *transfer) info() transferInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return transferInfo{
+		ID:          t.id,
+		RequestID:   t.requestID,
+		Client:      t.client,
+		Path:        t.path,
+		Route:       t.route,
+		Identity:    t.identity,
+		UpstreamURL: t.upstreamURL,
+		Started:     t.started,
+		Duration:    time.Since(t.started),
+		Status:      int(t.status.Load()),
+		BytesSent:   t.bytesSent.Load(),
+		Attempt:     t.attempts.Load(),
+		Resumes:     t.resumes.Load(),
+		Discarded:   t.discarded.Load(),
+		LastError:   t.lastError,
+		ETag:        t.etag,
+	}
+}
+
+// newAdminHandler serves the admin listener. The health, readiness and
+// version endpoints are open to orchestrators. With a token, every other
+// request must carry it as a bearer token; without one, the transfers API,
+// which can abort transfers, is disabled and the log level and bandwidth
+// limits can be read but not changed.
+func newAdminHandler(token string, ready http.Handler) http.Handler {
+	public := http.NewServeMux()
+	public.HandleFunc("/healthz", healthzHandler)
+	public.Handle("/readyz", ready)
+	public.HandleFunc("/version", versionHandler)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/loglevel", logLevelHandler)
+	mux.HandleFunc("/bandwidth", bandwidthHandler)
+	mux.HandleFunc("/events", eventsHandler)
+	if token == "" {
+		// Anyone reaching the admin listener may look, but not change
+		forbidden := func(what string) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "Forbidden: "+what+" requires an admin token", http.StatusForbidden)
+			}
+		}
+		mux.HandleFunc("/transfers", forbidden("the transfers API"))
+		mux.HandleFunc("/transfers/", forbidden("the transfers API"))
+		for _, method := range []string{http.MethodPut, http.MethodPost} {
+			mux.HandleFunc(method+" /loglevel", forbidden("changing the log level"))
+			mux.HandleFunc(method+" /bandwidth", forbidden("changing bandwidth limits"))
+		}
+		public.Handle("/", mux)
+		return public
+	}
+	mux.HandleFunc("GET /transfers", listTransfers)
+	mux.HandleFunc("GET /transfers/{id}", transferHandler(func(w http.ResponseWriter, t *transfer) {
+		writeJSON(w, http.StatusOK, t.info())
+	}))
+	mux.HandleFunc("POST /transfers/{id}/cancel", transferHandler(func(w http.ResponseWriter, t *transfer) {
+		slog.Warn("Cancelling transfer on admin request", "request_id", t.requestID, "path", t.path, "client", t.client)
+		t.abort()
+		writeJSON(w, http.StatusAccepted, t.info())
+	}))
+	mux.HandleFunc("POST /transfers/{id}/reconnect", transferHandler(func(w http.ResponseWriter, t *transfer) {
+		slog.Info("Reconnecting transfer on admin request", "request_id", t.requestID, "path", t.path, "client", t.client)
+		t.forceReconnect()
+		writeJSON(w, http.StatusAccepted, t.info())
+	}))
+	public.Handle("/", requireToken(token, mux))
+	return public
+}
+
+// requireToken rejects requests without "Authorization: Bearer <token>".
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="resilientproxy admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listTransfers reports the active transfers as JSON, or as a table with
+// ?format=text.
+func listTransfers(w http.ResponseWriter, r *http.Request) {
+	list := []transferInfo{}
+	for _, t := range activeTransfers.snapshot() {
+		list = append(list, t.info())
+	}
+	if r.URL.Query().Get("format") != "text" {
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tREQUEST ID\tCLIENT\tUPSTREAM\tBYTES SENT\tATTEMPT\tAGE\tETAG\tLAST ERROR")
+	for _, info := range list {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", info.ID, info.RequestID, info.Client, info.UpstreamURL,
+			info.BytesSent, info.Attempt, info.Duration.Round(time.Second), info.ETag, info.LastError)
+	}
+	tw.Flush()
+}
+
+// transferHandler looks up the transfer named by the {id} path value and
+// passes it to handle.
+func transferHandler(handle func(http.ResponseWriter, *transfer)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
+			return
+		}
+		t := activeTransfers.get(id)
+		if t == nil {
+			http.Error(w, "No such transfer", http.StatusNotFound)
+			return
+		}
+		handle(w, t)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
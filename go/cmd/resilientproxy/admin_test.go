@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminRefusesChangesWithoutToken(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/loglevel", http.StatusOK},
+		{http.MethodPut, "/loglevel", http.StatusForbidden},
+		{http.MethodGet, "/bandwidth", http.StatusOK},
+		{http.MethodPut, "/bandwidth", http.StatusForbidden},
+		{http.MethodPost, "/bandwidth", http.StatusForbidden},
+		{http.MethodGet, "/transfers", http.StatusForbidden},
+	}
+	handler := newAdminHandler("", http.NotFoundHandler())
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"per_client": 0}`)))
+		if w.Code != tt.want {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.path, tt.want, w.Code)
+		}
+	}
+
+	// With a token, changes need it
+	handler = newAdminHandler("secret", http.NotFoundHandler())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/bandwidth", strings.NewReader(`{"per_client": 0}`)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a change without the token to be refused, got %d", w.Code)
+	}
+}
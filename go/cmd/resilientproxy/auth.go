@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// errUnauthenticated is returned for requests without valid credentials.
+	errUnauthenticated = errors.New("authentication required")
+	// errForbidden is returned for authenticated requests to a route the
+	// identity may not use.
+	errForbidden = errors.New("identity not allowed on this route")
+)
+
+// anyIdentity in a route's allow list admits every authenticated client.
+const anyIdentity = "*"
+
+// authenticator identifies clients by a bearer token, HTTP Basic credentials
+// checked against an htpasswd file, or the subject of a verified client
+// certificate. A nil authenticator admits everybody anonymously.
+type authenticator struct {
+	tokens   map[string]string // identity by token
+	htpasswd map[string]string // password hash by user
+	subject  *regexp.Regexp    // client certificate subjects accepted; nil without mTLS
+}
+
+// newAuthenticator loads the configured credentials; it returns nil if none
+// are configured. tokensFile has a line "identity:token" per client and
+// htpasswdFile bcrypt or {SHA} hashes. Client certificates are accepted if
+// clientCA is set and their subject matches subjectPattern.
+func newAuthenticator(tokensFile, htpasswdFile, clientCA, subjectPattern string) (*authenticator, error) {
+	if tokensFile == "" && htpasswdFile == "" && clientCA == "" {
+		return nil, nil
+	}
+	a := &authenticator{}
+	var err error
+	if tokensFile != "" {
+		if a.tokens, err = readColonFile(tokensFile); err != nil {
+			return nil, err
+		}
+		identities := make(map[string]string, len(a.tokens))
+		for identity, token := range a.tokens {
+			identities[token] = identity
+		}
+		a.tokens = identities
+	}
+	if htpasswdFile != "" {
+		if a.htpasswd, err = readColonFile(htpasswdFile); err != nil {
+			return nil, err
+		}
+		for user, hash := range a.htpasswd {
+			if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+				return nil, fmt.Errorf("%s: unsupported hash for %s, expected bcrypt or {SHA}", htpasswdFile, user)
+			}
+		}
+	}
+	if clientCA != "" {
+		if a.subject, err = regexp.Compile(subjectPattern); err != nil {
+			return nil, fmt.Errorf("invalid client certificate subject pattern: %v", err)
+		}
+	}
+	return a, nil
+}
+
+// readColonFile reads "name:value" lines, skipping blank lines and comments.
+func readColonFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found || name == "" || value == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:value", path, n)
+		}
+		entries[name] = value
+	}
+	return entries, scanner.Err()
+}
+
+// tlsConfig returns the listener's TLS configuration asking for client
+// certificates signed by the CAs in clientCA, if set.
+func tlsConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   http1Only,
+	}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA: %v", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client CA %s", clientCA)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// authenticate returns the identity of the client of r, "" for a client
+// without credentials, or errUnauthenticated for invalid ones. Forward-proxy
+// clients send their credentials in Proxy-Authorization.
+func (a *authenticator) authenticate(r *http.Request, forward bool) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	header := "Authorization"
+	if forward {
+		header = "Proxy-Authorization"
+	}
+	scheme, credentials, _ := strings.Cut(r.Header.Get(header), " ")
+	switch {
+	case strings.EqualFold(scheme, "Bearer") && a.tokens != nil:
+		for token, identity := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(credentials), []byte(token)) == 1 {
+				return identity, nil
+			}
+		}
+		return "", errUnauthenticated
+	case strings.EqualFold(scheme, "Basic") && a.htpasswd != nil:
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", errUnauthenticated
+		}
+		user, password, _ := strings.Cut(string(decoded), ":")
+		if hash, ok := a.htpasswd[user]; ok && checkPassword(hash, password) {
+			return user, nil
+		}
+		return "", errUnauthenticated
+	case scheme != "":
+		return "", errUnauthenticated
+	}
+
+	// Certificates are verified against the client CA during the handshake.
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && a.subject != nil {
+		cert := r.TLS.PeerCertificates[0]
+		if !a.subject.MatchString(cert.Subject.String()) {
+			return "", errUnauthenticated
+		}
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName, nil
+		}
+		return cert.Subject.String(), nil
+	}
+	return "", nil
+}
+
+func checkPassword(hash, password string) bool {
+	if sha, ok := strings.CutPrefix(hash, "{SHA}"); ok {
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(sha), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// authorize checks that identity may use rt: any authenticated client may
+// use a route without an allow list.
+func (a *authenticator) authorize(rt *route, identity string) error {
+	if a == nil {
+		return nil
+	}
+	if identity == "" {
+		return errUnauthenticated
+	}
+	if rt != nil && rt.allow != nil && !slices.Contains(rt.allow, anyIdentity) && !slices.Contains(rt.allow, identity) {
+		return errForbidden
+	}
+	return nil
+}
+
+// deny answers a request that failed authentication or authorization.
+func (a *authenticator) deny(w http.ResponseWriter, err error, forward bool) {
+	if errors.Is(err, errForbidden) {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	var challenges []string
+	if a.tokens != nil {
+		challenges = append(challenges, `Bearer realm="resilientproxy"`)
+	}
+	if a.htpasswd != nil {
+		challenges = append(challenges, `Basic realm="resilientproxy"`)
+	}
+	status, header := http.StatusUnauthorized, "WWW-Authenticate"
+	if forward {
+		status, header = http.StatusProxyAuthRequired, "Proxy-Authenticate"
+	}
+	for _, challenge := range challenges {
+		w.Header().Add(header, challenge)
+	}
+	http.Error(w, http.StatusText(status)+": "+err.Error(), status)
+}
+
+type identityKey struct{}
+
+// withIdentity returns a context carrying the authenticated identity of the
+// client and a logger that adds it to every line.
+func withIdentity(ctx context.Context, identity string) context.Context {
+	ctx = context.WithValue(ctx, identityKey{}, identity)
+	if identity != "" {
+		ctx = context.WithValue(ctx, loggerKey{}, loggerFrom(ctx).With("identity", identity))
+	}
+	return ctx
+}
+
+// identityFrom returns the identity of ctx and whether the client was
+// authenticated already, like the requests inside an intercepted tunnel.
+func identityFrom(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityKey{}).(string)
+	return identity, ok
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticator(t *testing.T) {
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens")
+	htpasswd := filepath.Join(dir, "htpasswd")
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(tokens, []byte("# CI jobs\nci:ci-token\n"), 0600)
+	os.WriteFile(htpasswd, []byte("alice:"+string(hash)+"\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+	a, err := newAuthenticator(tokens, htpasswd, "", "")
+	if err != nil {
+		t.Fatalf("newAuthenticator: %v", err)
+	}
+
+	tests := []struct {
+		header, value string
+		forward       bool
+		want          string
+		wantErr       error
+	}{
+		{"", "", false, "", nil},
+		{"Authorization", "Bearer ci-token", false, "ci", nil},
+		{"Authorization", "Bearer wrong", false, "", errUnauthenticated},
+		{"Authorization", "Basic YWxpY2U6c2VjcmV0", false, "alice", nil}, // alice:secret
+		{"Authorization", "Basic YWxpY2U6d3Jvbmc=", false, "", errUnauthenticated},
+		{"Authorization", "Basic Ym9iOnBhc3N3b3Jk", false, "bob", nil}, // bob:password
+		{"Authorization", "Digest x", false, "", errUnauthenticated},
+		{"Proxy-Authorization", "Bearer ci-token", true, "ci", nil},
+		{"Authorization", "Bearer ci-token", true, "", nil},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		identity, err := a.authenticate(r, tt.forward)
+		if identity != tt.want || !errors.Is(err, tt.wantErr) {
+			t.Errorf("authenticate(%s: %s) = %q, %v, want %q, %v", tt.header, tt.value, identity, err, tt.want, tt.wantErr)
+		}
+	}
+
+	rt := &route{allow: []string{"alice"}}
+	if err := a.authorize(rt, "alice"); err != nil {
+		t.Errorf("authorize(alice) = %v", err)
+	}
+	if err := a.authorize(rt, "ci"); !errors.Is(err, errForbidden) {
+		t.Errorf("authorize(ci) = %v, want %v", err, errForbidden)
+	}
+	if err := a.authorize(&route{}, ""); !errors.Is(err, errUnauthenticated) {
+		t.Errorf("authorize of an anonymous client = %v, want %v", err, errUnauthenticated)
+	}
+	if err := (*authenticator)(nil).authorize(rt, ""); err != nil {
+		t.Errorf("authorize without authentication = %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// bandwidthLimits are bandwidth limits in bytes per second, 0 for none.
+type bandwidthLimits struct {
+	Global    int64            `json:"global"`     // all clients together
+	PerClient int64            `json:"per_client"` // each client identity, or address if anonymous
+	Routes    map[string]int64 `json:"routes"`     // all clients of a route together, by route name
+	Upstream  int64            `json:"upstream"`   // all reads from upstreams together
+}
+
+// bandwidthLimiter hands out the token buckets transfers draw from. Changing
+// the limits retunes the buckets in place, so active transfers keep running
+// at the new rate.
+type bandwidthLimiter struct {
+	mu       sync.Mutex
+	limits   bandwidthLimits
+	global   *rate.Limiter
+	upstream *rate.Limiter
+	routes   map[string]*rate.Limiter
+	clients  map[string]*clientBucket
+}
+
+// clientBucket is the bucket of a client, kept while it has transfers.
+type clientBucket struct {
+	limiter   *rate.Limiter
+	transfers int
+}
+
+// bandwidth limits all transfers of the proxy.
+var bandwidth = newBandwidthLimiter()
+
+func newBandwidthLimiter() *bandwidthLimiter {
+	return &bandwidthLimiter{
+		global:   newBucket(0),
+		upstream: newBucket(0),
+		routes:   make(map[string]*rate.Limiter),
+		clients:  make(map[string]*clientBucket),
+	}
+}
+
+// newBucket returns a bucket for bytesPerSecond holding a second's worth of
+// tokens; 0 does not limit.
+func newBucket(bytesPerSecond int64) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, 0)
+	setBucket(l, bytesPerSecond)
+	return l
+}
+
+func setBucket(l *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetBurst(int(bytesPerSecond))
+	l.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// get returns the current limits.
+func (b *bandwidthLimiter) get() bandwidthLimits {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	limits := b.limits
+	limits.Routes = maps.Clone(b.limits.Routes)
+	return limits
+}
+
+// set replaces the limits.
+func (b *bandwidthLimiter) set(limits bandwidthLimits) error {
+	if limits.Global < 0 || limits.PerClient < 0 || limits.Upstream < 0 {
+		return fmt.Errorf("bandwidth limits must not be negative")
+	}
+	for route, limit := range limits.Routes {
+		if limit < 0 {
+			return fmt.Errorf("bandwidth limit of route %s must not be negative", route)
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limits = limits
+	b.limits.Routes = maps.Clone(limits.Routes)
+	setBucket(b.global, limits.Global)
+	setBucket(b.upstream, limits.Upstream)
+	for route, l := range b.routes {
+		setBucket(l, limits.Routes[route])
+	}
+	for _, c := range b.clients {
+		setBucket(c.limiter, limits.PerClient)
+	}
+	return nil
+}
+
+// acquire returns the buckets of the transfer of ctx, keyed by its client's
+// identity or address. Background downloads have no client, so only the
+// upstream limit applies to them. The caller must release the result.
+func (b *bandwidthLimiter) acquire(ctx context.Context) *transferBandwidth {
+	tb := &transferBandwidth{limiter: b, upstream: b.upstream}
+	t := transferFrom(ctx)
+	if t == nil || t.client == backgroundClient {
+		return tb
+	}
+	tb.client = t.clientKey()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	route, ok := b.routes[t.route]
+	if !ok {
+		route = newBucket(b.limits.Routes[t.route])
+		b.routes[t.route] = route
+	}
+	c, ok := b.clients[tb.client]
+	if !ok {
+		c = &clientBucket{limiter: newBucket(b.limits.PerClient)}
+		b.clients[tb.client] = c
+	}
+	c.transfers++
+	tb.buckets = []*rate.Limiter{c.limiter, route, b.global}
+	return tb
+}
+
+// transferBandwidth are the buckets a transfer draws from.
+type transferBandwidth struct {
+	limiter  *bandwidthLimiter
+	client   string
+	buckets  []*rate.Limiter // client-facing: client, route, global
+	upstream *rate.Limiter
+}
+
+// release gives back the client's bucket once its last transfer ends.
+func (tb *transferBandwidth) release() {
+	if tb.buckets == nil {
+		return
+	}
+	b := tb.limiter
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c := b.clients[tb.client]; c != nil {
+		if c.transfers--; c.transfers == 0 {
+			delete(b.clients, tb.client)
+		}
+	}
+}
+
+// unlimited reports whether none of the buckets currently limits the
+// transfer.
+func (tb *transferBandwidth) unlimited() bool {
+	if tb.upstream.Limit() != rate.Inf {
+		return false
+	}
+	for _, l := range tb.buckets {
+		if l.Limit() != rate.Inf {
+			return false
+		}
+	}
+	return true
+}
+
+// waitClient waits until n bytes may be written to the client.
+func (tb *transferBandwidth) waitClient(ctx context.Context, n int) error {
+	return waitBuckets(ctx, "client", n, tb.buckets...)
+}
+
+// waitUpstream waits until n bytes read from the upstream may be passed on.
+func (tb *transferBandwidth) waitUpstream(ctx context.Context, n int) error {
+	return waitBuckets(ctx, "upstream", n, tb.upstream)
+}
+
+// waitBuckets takes n tokens from each bucket, in chunks no bucket's burst
+// exceeds.
+func waitBuckets(ctx context.Context, direction string, n int, buckets ...*rate.Limiter) error {
+	started := time.Now()
+	defer func() {
+		if waited := time.Since(started); waited > time.Millisecond {
+			bandwidthWaited.WithLabelValues(direction).Add(waited.Seconds())
+		}
+	}()
+	for n > 0 {
+		chunk := n
+		for _, l := range buckets {
+			if l.Limit() != rate.Inf {
+				chunk = max(min(chunk, l.Burst()), 1)
+			}
+		}
+		for _, l := range buckets {
+			if err := l.WaitN(ctx, chunk); err != nil {
+				if ctx.Err() != nil {
+					return context.Cause(ctx)
+				}
+				if l.Limit() != rate.Inf && l.Burst() < chunk {
+					// The limit changed and lowered the burst; try smaller chunks
+					chunk = 0
+					break
+				}
+				return err // The wait would outlast the deadline of ctx
+			}
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// bandwidthHandler reports the bandwidth limits as JSON and changes those
+// given in the body of a PUT or POST, e.g. {"per_client": 1048576}.
+func bandwidthHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		limits := bandwidth.get()
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&limits); err != nil {
+			http.Error(w, "Invalid bandwidth limits: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := bandwidth.set(limits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("Bandwidth limits changed", "global", limits.Global, "per_client", limits.PerClient,
+			"routes", limits.Routes, "upstream", limits.Upstream)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, bandwidth.get())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	b := newBandwidthLimiter()
+	if err := b.set(bandwidthLimits{PerClient: 1000, Routes: map[string]int64{"slow": 500}}); err != nil {
+		t.Fatal(err)
+	}
+	transfer := func(client, identity, route string) context.Context {
+		return withTransfer(context.Background(), &transfer{client: client, identity: identity, route: route})
+	}
+
+	// Anonymous clients are keyed by address, authenticated ones by identity
+	first := b.acquire(transfer("10.0.0.1:1234", "", "slow"))
+	second := b.acquire(transfer("10.0.0.1:5678", "", "fast"))
+	alice := b.acquire(transfer("10.0.0.1:9999", "alice", "fast"))
+	if first.buckets[0] != second.buckets[0] || first.buckets[0] == alice.buckets[0] {
+		t.Errorf("Expected the transfers of an address to share a bucket apart from alice's")
+	}
+	if got := first.buckets[1].Limit(); got != 500 {
+		t.Errorf("Route limit = %v, want 500", got)
+	}
+	if got := second.buckets[1].Limit(); got != rate.Inf {
+		t.Errorf("Unlimited route limit = %v, want Inf", got)
+	}
+	if background := b.acquire(transfer(backgroundClient, "", "detached")); background.buckets != nil {
+		t.Errorf("Expected background downloads to have no client-facing buckets")
+	}
+
+	// Changing the limits retunes the buckets of active transfers
+	if err := b.set(bandwidthLimits{PerClient: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	if got := first.buckets[0].Limit(); got != 2000 {
+		t.Errorf("Client limit after the change = %v, want 2000", got)
+	}
+	if got := first.buckets[1].Limit(); got != rate.Inf {
+		t.Errorf("Removed route limit = %v, want Inf", got)
+	}
+	if err := b.set(bandwidthLimits{Global: -1}); err == nil {
+		t.Errorf("Expected negative limits to be refused")
+	}
+
+	first.release()
+	if _, ok := b.clients["10.0.0.1"]; !ok {
+		t.Errorf("Expected the bucket to stay while the client has transfers")
+	}
+	second.release()
+	alice.release()
+	if len(b.clients) != 0 {
+		t.Errorf("Expected no client buckets after the transfers ended, got %d", len(b.clients))
+	}
+}
+
+func TestWaitBuckets(t *testing.T) {
+	// Waits longer than the burst are split into chunks
+	l := newBucket(1000)
+	l.AllowN(time.Now(), 1000)
+	started := time.Now()
+	if err := waitBuckets(context.Background(), "client", 1500, l, newBucket(0)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("Expected 1500 bytes at 1000 bytes/s to take over a second, took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := waitBuckets(ctx, "client", 10000, l); err == nil {
+		t.Errorf("Expected a cancelled wait to fail")
+	}
+
+	// A wait that would outlast the deadline fails right away
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	started = time.Now()
+	if err := waitBuckets(ctx, "client", 10000, l); err == nil {
+		t.Errorf("Expected a wait past the deadline to fail")
+	}
+	if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected a wait past the deadline to fail without waiting, took %v", elapsed)
+	}
+}
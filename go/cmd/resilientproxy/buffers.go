@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultBufferSize is the size of the buffer each transfer copies the
+// upstream response through.
+const defaultBufferSize = 1 << 20
+
+// bufferPool hands out the buffers of transfers and takes them back for the
+// next ones. A memory budget caps the bytes of buffers in use: transfers that
+// would exceed it wait for a buffer to come back before contacting the
+// upstream, served round-robin by client like requests waiting for a slot.
+type bufferPool struct {
+	size   int
+	pool   sync.Pool
+	budget *slotQueue // one slot per buffer
+}
+
+// buffers are the buffers of all transfers.
+var buffers = newBufferPool(defaultBufferSize, 0)
+
+// newBufferPool returns a pool of buffers of size bytes keeping at most
+// budget bytes in use, or any number for a budget of 0.
+func newBufferPool(size int, budget int64) *bufferPool {
+	bp := &bufferPool{size: size, budget: &slotQueue{maxWaiting: -1}}
+	if budget > 0 {
+		bp.budget.limit = max(1, int(budget/int64(size)))
+	}
+	bp.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return bp
+}
+
+// get waits until the budget allows another buffer for the transfer of ctx
+// and returns it. It fails only if ctx is done. The caller must put the
+// buffer back.
+func (bp *bufferPool) get(ctx context.Context) (*[]byte, error) {
+	if err := bp.budget.acquire(ctx, transferFrom(ctx).clientKey()); err != nil {
+		return nil, err
+	}
+	return bp.pool.Get().(*[]byte), nil
+}
+
+// put returns a buffer from get.
+func (bp *bufferPool) put(buf *[]byte) {
+	bp.pool.Put(buf)
+	bp.budget.release()
+}
+
+// inUse returns the bytes of buffers handed out.
+func (bp *bufferPool) inUse() int64 {
+	bp.budget.mu.Lock()
+	defer bp.budget.mu.Unlock()
+	return int64(bp.budget.active) * int64(bp.size)
+}
+
+// discard reads n bytes from body through buf and drops them, so a resumed
+// response lines up with what the client already has. It returns the number
+// of bytes dropped.
+func discard(ctx context.Context, body io.Reader, n int64, buf []byte) (int64, error) {
+	logger := loggerFrom(ctx)
+	var consumed int64
+	for consumed < n {
+		read, err := io.ReadFull(body, buf[:min(n-consumed, int64(len(buf)))])
+		consumed += int64(read)
+		alignmentDiscardedBytes.Add(float64(read))
+		transferFrom(ctx).countDiscarded(int64(read))
+		if err != nil {
+			return consumed, err
+		}
+		logger.Debug("Consumed bytes to align with expected range", "consumed", consumed, "total", n, "progress", 100*consumed/n)
+	}
+	return consumed, nil
+}
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "resilientproxy",
+			Name:      "buffer_bytes_in_use",
+			Help:      "Bytes of transfer buffers in use.",
+		}, func() float64 { return float64(buffers.inUse()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "resilientproxy",
+			Name:      "transfers_waiting_for_memory",
+			Help:      "Transfers waiting for the memory budget to allow another buffer.",
+		}, func() float64 { return float64(buffers.budget.queued()) }),
+	)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBufferPoolKeepsToTheBudget(t *testing.T) {
+	bp := newBufferPool(4096, 10000)
+	first, err := bp.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := bp.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*first) != 4096 || bp.inUse() != 8192 {
+		t.Errorf("Expected two buffers of 4096 bytes in use, got %d bytes each and %d in use", len(*first), bp.inUse())
+	}
+
+	// A third buffer would exceed the budget
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := bp.get(ctx); err == nil {
+		t.Errorf("Expected a transfer over the budget to wait")
+	}
+	bp.put(first)
+	if third, err := bp.get(context.Background()); err != nil {
+		t.Errorf("Expected the returned buffer to be available, got %v", err)
+	} else {
+		bp.put(third)
+	}
+	bp.put(second)
+	if bp.inUse() != 0 {
+		t.Errorf("Expected no buffers in use, got %d bytes", bp.inUse())
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	body := strings.NewReader("0123456789abcdef")
+	n, err := discard(context.Background(), body, 10, make([]byte, 4))
+	if err != nil || n != 10 {
+		t.Fatalf("Expected 10 bytes dropped, got %d, %v", n, err)
+	}
+	rest := make([]byte, 16)
+	if got, _ := body.Read(rest); string(rest[:got]) != "abcdef" {
+		t.Errorf("Expected the body to continue after the dropped bytes, got %q", rest[:got])
+	}
+	if n, err := discard(context.Background(), strings.NewReader("short"), 10, make([]byte, 4)); err == nil || n != 5 {
+		t.Errorf("Expected a short body to fail after 5 bytes, got %d, %v", n, err)
+	}
+}
+
+// slowClient is a client reading the response slowly.
+type slowClient struct {
+	header http.Header
+	n      atomic.Int64
+}
+
+func (c *slowClient) Header() http.Header { return c.header }
+func (c *slowClient) WriteHeader(int)     {}
+func (c *slowClient) Write(p []byte) (int, error) {
+	time.Sleep(2 * time.Millisecond)
+	c.n.Add(int64(len(p)))
+	return len(p), nil
+}
+func (c *slowClient) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrHijacked
+}
+
+// BenchmarkSlowClients runs 1000 concurrent transfers to slow clients and
+// reports the peak heap, which the memory budget keeps flat.
+func BenchmarkSlowClients(b *testing.B) {
+	content := bytes.Repeat([]byte("x"), 256<<10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+	defer func(bp *bufferPool) { buffers = bp }(buffers)
+	setupLogging(io.Discard, "text", "error")
+	defer setupLogging(os.Stderr, "text", "info")
+
+	for _, budget := range []int64{0, 32 << 20} {
+		b.Run(fmt.Sprintf("budget=%dMiB", budget>>20), func(b *testing.B) {
+			buffers = newBufferPool(defaultBufferSize, budget)
+			runtime.GC()
+			var peak atomic.Uint64
+			done := make(chan struct{})
+			go func() {
+				var stats runtime.MemStats
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(10 * time.Millisecond):
+					}
+					runtime.ReadMemStats(&stats)
+					if stats.HeapInuse > peak.Load() {
+						peak.Store(stats.HeapInuse)
+					}
+				}
+			}()
+			for b.Loop() {
+				var wg sync.WaitGroup
+				for range 1000 {
+					wg.Go(func() {
+						r := httptest.NewRequest(http.MethodGet, "/content", nil)
+						c := &slowClient{header: make(http.Header)}
+						if err := resilientGet(r, upstream.URL, c, c); err != nil || c.n.Load() != int64(len(content)) {
+							b.Errorf("Expected the whole content, got %d bytes, %v", c.n.Load(), err)
+						}
+					})
+				}
+				wg.Wait()
+			}
+			close(done)
+			b.ReportMetric(float64(peak.Load())/(1<<20), "peak-heap-MiB")
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Circuit states of an upstream
+const (
+	circuitClosed = "closed" // The upstream answers
+	circuitOpen   = "open"   // The latest requests to the upstream all failed
+)
+
+// circuitBreaker tracks whether each upstream is reachable. A circuit opens
+// after threshold consecutive failed requests and closes on the next success.
+// Transfers keep retrying either way; the state is reported so operators
+// learn when an upstream goes down and when it recovers.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	upstreams map[string]*circuit
+}
+
+type circuit struct {
+	failures int // consecutive failed requests
+	open     bool
+	since    time.Time // of the latest state change
+}
+
+var upstreamCircuits = &circuitBreaker{threshold: 5, upstreams: make(map[string]*circuit)}
+
+var circuitOpenGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "resilientproxy",
+	Name:      "upstream_circuit_open",
+	Help:      "1 if the latest requests to the upstream all failed, 0 otherwise.",
+}, []string{"upstream"})
+
+func init() {
+	metricsRegistry.MustRegister(circuitOpenGauge)
+}
+
+// record updates the circuit of upstream with the result of a request; err
+// is nil if the upstream answered.
+func (cb *circuitBreaker) record(upstream string, err error) {
+	cb.mu.Lock()
+	c, ok := cb.upstreams[upstream]
+	if !ok {
+		c = &circuit{since: time.Now()}
+		cb.upstreams[upstream] = c
+	}
+	var changed bool
+	var downtime time.Duration
+	if err == nil {
+		c.failures = 0
+		if c.open {
+			changed, downtime = true, time.Since(c.since)
+			c.open, c.since = false, time.Now()
+		}
+	} else {
+		c.failures++
+		if !c.open && c.failures >= cb.threshold {
+			changed = true
+			c.open, c.since = true, time.Now()
+		}
+	}
+	failures, open := c.failures, c.open
+	cb.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if open {
+		circuitOpenGauge.WithLabelValues(upstream).Set(1)
+		slog.Warn("Upstream circuit opened", "upstream", upstream, "failures", failures, "error", err)
+		notifier.notify(notifyCircuitOpen, func(n *notification) {
+			n.Upstream = upstream
+			n.Failures = failures
+			n.Error = err.Error()
+		})
+	} else {
+		circuitOpenGauge.WithLabelValues(upstream).Set(0)
+		slog.Info("Upstream circuit closed", "upstream", upstream, "downtime", downtime.Round(time.Millisecond))
+		notifier.notify(notifyCircuitClosed, func(n *notification) {
+			n.Upstream = upstream
+			n.Downtime = downtime
+		})
+	}
+}
+
+// state returns the circuit state of upstream.
+func (cb *circuitBreaker) state(upstream string) string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if c, ok := cb.upstreams[upstream]; ok && c.open {
+		return circuitOpen
+	}
+	return circuitClosed
+}
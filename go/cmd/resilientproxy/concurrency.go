@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// errQueueFull refuses a request arriving while the wait queue is full.
+	errQueueFull = errors.New("too many requests waiting")
+	// errQueueTimeout refuses a request that waited too long for a slot.
+	errQueueTimeout = errors.New("timed out waiting for a free slot")
+)
+
+// slotQueue hands out a limited number of slots. Requests finding none free
+// wait in a queue served round-robin by client, so a burst of one client
+// cannot starve the others.
+type slotQueue struct {
+	limit      int           // slots, 0 for no limit
+	maxWaiting int           // waiting requests beyond which acquire fails, -1 for no limit
+	timeout    time.Duration // longest wait, 0 for no limit
+
+	mu      sync.Mutex
+	active  int
+	waiting int
+	clients []*clientWaiters // clients with waiting requests, the next one to serve first
+}
+
+// clientWaiters are the waiting requests of a client, oldest first.
+type clientWaiters struct {
+	client  string
+	waiters []chan struct{}
+}
+
+// requestSlots limits the client requests served at once.
+var requestSlots = &slotQueue{maxWaiting: -1}
+
+// acquire waits for a slot for a request of client. It fails if the queue is
+// full, the wait times out or ctx is done. The caller must release the slot.
+func (q *slotQueue) acquire(ctx context.Context, client string) error {
+	q.mu.Lock()
+	if q.limit <= 0 || (q.active < q.limit && q.waiting == 0) {
+		q.active++
+		q.mu.Unlock()
+		return nil
+	}
+	if q.maxWaiting >= 0 && q.waiting >= q.maxWaiting {
+		q.mu.Unlock()
+		return errQueueFull
+	}
+	ready := make(chan struct{})
+	q.enqueue(client, ready)
+	q.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if q.timeout > 0 {
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	case <-timeout:
+		err = errQueueTimeout
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.dequeue(client, ready) {
+		// The slot was handed over meanwhile; pass it on
+		q.handOver()
+	}
+	return err
+}
+
+// release frees a slot, handing it to the next waiting request if any.
+func (q *slotQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handOver()
+}
+
+func (q *slotQueue) handOver() {
+	if len(q.clients) == 0 {
+		q.active--
+		return
+	}
+	c := q.clients[0]
+	ready := c.waiters[0]
+	c.waiters = c.waiters[1:]
+	q.clients = q.clients[1:]
+	if len(c.waiters) > 0 {
+		q.clients = append(q.clients, c) // Back of the round
+	}
+	q.waiting--
+	close(ready)
+}
+
+func (q *slotQueue) enqueue(client string, ready chan struct{}) {
+	q.waiting++
+	for _, c := range q.clients {
+		if c.client == client {
+			c.waiters = append(c.waiters, ready)
+			return
+		}
+	}
+	q.clients = append(q.clients, &clientWaiters{client: client, waiters: []chan struct{}{ready}})
+}
+
+// dequeue removes a waiting request, reporting whether it was still waiting.
+func (q *slotQueue) dequeue(client string, ready chan struct{}) bool {
+	for i, c := range q.clients {
+		if c.client != client {
+			continue
+		}
+		for j, w := range c.waiters {
+			if w == ready {
+				c.waiters = append(c.waiters[:j], c.waiters[j+1:]...)
+				if len(c.waiters) == 0 {
+					q.clients = append(q.clients[:i], q.clients[i+1:]...)
+				}
+				q.waiting--
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// queued returns the number of waiting requests.
+func (q *slotQueue) queued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiting
+}
+
+// refuse answers a request that got no slot with 503 and a Retry-After
+// header of retryAfter, rounded up to whole seconds.
+func refuse(w http.ResponseWriter, err error, retryAfter time.Duration) {
+	reason := "queue_full"
+	if errors.Is(err, errQueueTimeout) {
+		reason = "queue_timeout"
+	}
+	rejectedRequests.WithLabelValues(reason).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	http.Error(w, "Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
+}
+
+// hostLimiter limits the connections to each upstream host. Requests over the
+// limit wait as long as their transfer lasts, served round-robin by client.
+type hostLimiter struct {
+	limit int // connections per host, 0 for no limit
+
+	mu    sync.Mutex
+	hosts map[string]*hostSlots
+}
+
+// hostSlots are the slots of a host, kept while requests use or wait for them.
+type hostSlots struct {
+	queue *slotQueue
+	users int
+}
+
+// upstreamSlots limits the connections to upstream hosts.
+var upstreamSlots = &hostLimiter{hosts: make(map[string]*hostSlots)}
+
+// acquire waits for a connection slot for host on behalf of client and
+// returns the function releasing it.
+func (h *hostLimiter) acquire(ctx context.Context, host, client string) (func(), error) {
+	if h.limit <= 0 {
+		return func() {}, nil
+	}
+	h.mu.Lock()
+	s, ok := h.hosts[host]
+	if !ok {
+		s = &hostSlots{queue: &slotQueue{limit: h.limit, maxWaiting: -1}}
+		h.hosts[host] = s
+	}
+	s.users++
+	h.mu.Unlock()
+
+	done := func(acquired bool) {
+		if acquired {
+			s.queue.release()
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if s.users--; s.users == 0 {
+			delete(h.hosts, host)
+		}
+	}
+	if err := s.queue.acquire(ctx, client); err != nil {
+		done(false)
+		return nil, err
+	}
+	var once sync.Once
+	return func() { once.Do(func() { done(true) }) }, nil
+}
+
+// releasingBody releases the upstream connection slot of a response once its
+// body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+var rejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "resilientproxy",
+	Name:      "rejected_requests_total",
+	Help:      "Client requests refused with 503 for lack of a free slot, by reason (queue_full, queue_timeout).",
+}, []string{"reason"})
+
+func init() {
+	metricsRegistry.MustRegister(
+		rejectedRequests,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "resilientproxy",
+			Name:      "queued_requests",
+			Help:      "Client requests waiting for a free slot.",
+		}, func() float64 { return float64(requestSlots.queued()) }),
+	)
+}
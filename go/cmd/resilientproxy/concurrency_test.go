@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSlotQueueServesClientsRoundRobin(t *testing.T) {
+	q := &slotQueue{limit: 1, maxWaiting: 3}
+	if err := q.acquire(context.Background(), "ci"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two requests of a greedy client queue before one of another client
+	served := make(chan string, 3)
+	wait := func(client string) {
+		queued := q.queued()
+		go func() {
+			if err := q.acquire(context.Background(), client); err != nil {
+				t.Error(err)
+				return
+			}
+			served <- client
+		}()
+		for q.queued() == queued {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wait("ci")
+	wait("ci")
+	wait("alice")
+	if err := q.acquire(context.Background(), "bob"); !errors.Is(err, errQueueFull) {
+		t.Errorf("Expected a full queue to refuse, got %v", err)
+	}
+
+	var order []string
+	for range 3 {
+		q.release()
+		order = append(order, <-served)
+	}
+	if order[0] != "ci" || order[1] != "alice" || order[2] != "ci" {
+		t.Errorf("Expected the clients to take turns, got %v", order)
+	}
+	q.release()
+	if q.active != 0 || q.waiting != 0 {
+		t.Errorf("Expected no active or waiting requests, got %d and %d", q.active, q.waiting)
+	}
+}
+
+func TestSlotQueueGivesUpWaiting(t *testing.T) {
+	q := &slotQueue{limit: 1, maxWaiting: -1, timeout: 20 * time.Millisecond}
+	if err := q.acquire(context.Background(), "ci"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.acquire(context.Background(), "alice"); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("Expected the wait to time out, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.acquire(ctx, "alice"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled wait to fail, got %v", err)
+	}
+	if q.waiting != 0 {
+		t.Errorf("Expected requests that gave up to leave the queue, %d still waiting", q.waiting)
+	}
+	q.release()
+	if err := q.acquire(context.Background(), "alice"); err != nil {
+		t.Errorf("Expected the freed slot to be available, got %v", err)
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	h := &hostLimiter{limit: 1, hosts: make(map[string]*hostSlots)}
+	release, err := h.acquire(context.Background(), "mirror1:443", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := h.acquire(context.Background(), "mirror2:443", "ci")
+	if err != nil {
+		t.Fatalf("Expected hosts to have separate limits, got %v", err)
+	}
+	other()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := h.acquire(ctx, "mirror1:443", "alice"); err == nil {
+		t.Errorf("Expected a second connection to the host to wait")
+	}
+	release()
+	release() // Closing a body twice releases once
+	if len(h.hosts) != 0 {
+		t.Errorf("Expected no hosts to be tracked without connections, got %d", len(h.hosts))
+	}
+}
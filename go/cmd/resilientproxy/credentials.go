@@ -0,0 +1,219 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream credential types
+const (
+	credentialsHeader = "header"    // A static header, e.g. an API key
+	credentialsBasic  = "basic"     // HTTP Basic
+	credentialsOAuth2 = "oauth2"    // A bearer token from an OAuth2 client-credentials grant
+	credentialsSigV4  = "aws-sigv4" // AWS Signature Version 4, e.g. for S3 or MinIO
+)
+
+// tokenExpiryMargin is how long before its expiry an OAuth2 token is
+// renewed, so it does not expire on the way to the upstream.
+const tokenExpiryMargin = 30 * time.Second
+
+// credentialsConfig are the upstream credentials of a route in the -routes
+// file. Values may refer to environment variables as ${NAME}. Without an
+// access_key_id, SigV4 takes its keys from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN; without a region, from
+// AWS_REGION.
+type credentialsConfig struct {
+	Type         string   `json:"type"`
+	Header       string   `json:"header"`
+	Value        string   `json:"value"`
+	Username     string   `json:"username"`
+	Password     string   `json:"password"`
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+	Region          string `json:"region"`
+	Service         string `json:"service"` // "s3" if missing
+}
+
+// credentials authenticate the proxy's requests to the upstreams of a route,
+// so clients need not hold them.
+type credentials struct {
+	kind   string
+	header string // credentialsHeader: the header name
+	value  string // credentialsHeader: the header value; credentialsBasic: user:password
+	oauth2 *credentialsConfig
+	aws    awsKeys
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time // zero if the token does not expire
+}
+
+func newCredentials(c *credentialsConfig) (*credentials, error) {
+	expanded := *c
+	for _, value := range []*string{&expanded.Value, &expanded.Username, &expanded.Password, &expanded.ClientID, &expanded.ClientSecret,
+		&expanded.AccessKeyID, &expanded.SecretAccessKey, &expanded.SessionToken} {
+		*value = os.ExpandEnv(*value)
+	}
+	creds := &credentials{kind: c.Type}
+	switch c.Type {
+	case credentialsHeader:
+		if c.Header == "" || expanded.Value == "" {
+			return nil, fmt.Errorf("header credentials need a header and a value")
+		}
+		creds.header, creds.value = http.CanonicalHeaderKey(c.Header), expanded.Value
+	case credentialsBasic:
+		if expanded.Username == "" {
+			return nil, fmt.Errorf("basic credentials need a username")
+		}
+		creds.value = expanded.Username + ":" + expanded.Password
+	case credentialsOAuth2:
+		if u, err := url.Parse(c.TokenURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("oauth2 credentials need an http or https token_url")
+		}
+		if expanded.ClientID == "" {
+			return nil, fmt.Errorf("oauth2 credentials need a client_id")
+		}
+		creds.oauth2 = &expanded
+	case credentialsSigV4:
+		creds.aws = awsKeys{
+			accessKeyID:     expanded.AccessKeyID,
+			secretAccessKey: expanded.SecretAccessKey,
+			sessionToken:    expanded.SessionToken,
+			region:          cmp.Or(c.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")),
+			service:         cmp.Or(c.Service, "s3"),
+		}
+		if expanded.AccessKeyID == "" {
+			// The keys of the environment belong together
+			creds.aws.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+			creds.aws.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+			creds.aws.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+		if creds.aws.accessKeyID == "" || creds.aws.secretAccessKey == "" {
+			return nil, fmt.Errorf("aws-sigv4 credentials need an access_key_id and a secret_access_key")
+		}
+		if creds.aws.region == "" {
+			return nil, fmt.Errorf("aws-sigv4 credentials need a region")
+		}
+	default:
+		return nil, fmt.Errorf("unknown credentials type %q, expected %s, %s, %s or %s", c.Type, credentialsHeader, credentialsBasic, credentialsOAuth2, credentialsSigV4)
+	}
+	return creds, nil
+}
+
+// send sends req with the credentials; c may be nil. If the upstream rejects
+// an OAuth2 token with 401, send fetches a new one and sends req once more.
+func (c *credentials) send(client *http.Client, req *http.Request) (*http.Response, error) {
+	if c == nil {
+		return client.Do(req)
+	}
+	token, err := c.apply(client, req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.kind != credentialsOAuth2 {
+		return resp, err
+	}
+	resp.Body.Close()
+	ctx := req.Context()
+	loggerFrom(ctx).Warn("Upstream rejected the OAuth2 token, renewing it and retrying", "url", redactQuery(req.URL.String()))
+	c.invalidate(token)
+	req = req.Clone(ctx)
+	if _, err := c.apply(client, req); err != nil {
+		return nil, err
+	}
+	transferFrom(ctx).countAttempt()
+	return client.Do(req)
+}
+
+// apply adds the credentials to req and returns the OAuth2 token used. SigV4
+// signs the final headers of req, so it must come after any other change.
+func (c *credentials) apply(client *http.Client, req *http.Request) (string, error) {
+	switch c.kind {
+	case credentialsHeader:
+		req.Header.Set(c.header, c.value)
+	case credentialsBasic:
+		user, password, _ := strings.Cut(c.value, ":")
+		req.SetBasicAuth(user, password)
+	case credentialsOAuth2:
+		token, err := c.currentToken(req.Context(), client)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return token, nil
+	case credentialsSigV4:
+		signV4(req, c.aws, time.Now())
+	}
+	return "", nil
+}
+
+// currentToken returns the cached OAuth2 token, fetching a new one from the
+// token endpoint if there is none or it is about to expire.
+func (c *credentials) currentToken(ctx context.Context, client *http.Client) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && (c.expiry.IsZero() || time.Until(c.expiry) > tokenExpiryMargin) {
+		return c.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.oauth2.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.oauth2.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.oauth2.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.oauth2.ClientID), url.QueryEscape(c.oauth2.ClientSecret))
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch OAuth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch OAuth2 token: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OAuth2 token endpoint returned status: %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("OAuth2 token endpoint returned no access_token")
+	}
+	c.token, c.expiry = token.AccessToken, time.Time{}
+	if token.ExpiresIn > 0 {
+		c.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	loggerFrom(ctx).Info("Fetched OAuth2 token", "token_url", c.oauth2.TokenURL, "expiry", c.expiry)
+	return c.token, nil
+}
+
+// invalidate drops token unless another request has renewed it already.
+func (c *credentials) invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == token {
+		c.token = ""
+	}
+}
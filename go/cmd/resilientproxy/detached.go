@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errDownloadContentChanged = errors.New("content changed during background download")
+
+// backgroundClient is the client of the transfer of a background download.
+const backgroundClient = "background"
+
+// downloadManager runs upstream downloads in the background, independent of
+// the client that started them. Clients read from the local copy while it
+// grows, so a client that reconnects with a Range request is served from what
+// has already been fetched instead of waiting for the upstream again.
+type downloadManager struct {
+	ctx      context.Context
+	upstream string
+	dir      string
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	downloads map[string]*download // by path and query
+}
+
+func newDownloadManager(ctx context.Context, upstream, dir string, ttl time.Duration) (*downloadManager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create cache directory: %v", err)
+	}
+	return &downloadManager{
+		ctx:       ctx,
+		upstream:  upstream,
+		dir:       dir,
+		ttl:       ttl,
+		downloads: make(map[string]*download),
+	}, nil
+}
+
+// acquire returns the running or completed download for uri, the path and
+// query of the upstream request, starting a new one if there is none. The
+// caller must release it when done reading.
+func (m *downloadManager) acquire(ctx context.Context, uri string) (*download, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path, _, _ := strings.Cut(uri, "?") // The query may hold a signature
+	if d, ok := m.downloads[uri]; ok {
+		d.acquire()
+		detachedDownloads.WithLabelValues("joined").Inc()
+		loggerFrom(ctx).Info("Joining background download", "path", path, "download_id", d.id)
+		return d, nil
+	}
+
+	file, err := os.CreateTemp(m.dir, "download-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cache file: %v", err)
+	}
+	// Nothing but the upstream path and query is taken from the client
+	// request, and the download only stops when the server shuts down.
+	id := newRequestID()
+	spanCtx, span := tracer.Start(m.ctx, "detached download",
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(attribute.String("url.path", path), attribute.String("resilientproxy.request_id", id)))
+	t, reqCtx := activeTransfers.begin(withRoute(withRequestID(spanCtx, id), routeFrom(ctx)), id, backgroundClient, path, transferFrom(ctx).route)
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, uri, nil)
+	if err != nil {
+		endSpan(span, err)
+		activeTransfers.end(t)
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	d := newDownload(id, file)
+	d.acquire()
+	m.downloads[uri] = d
+	detachedDownloads.WithLabelValues("started").Inc()
+	loggerFrom(ctx).Info("Starting background download", "path", path, "download_id", id, "file", file.Name())
+	logger := loggerFrom(req.Context())
+
+	go func() {
+		defer activeTransfers.end(t)
+		status, err := d.finish(resilientGet(req, m.upstream, d, &countingWriter{d, t}))
+		span.SetAttributes(attribute.Int("http.response.status_code", status), attribute.Int64("http.response.body.size", t.bytesSent.Load()))
+		endSpan(span, err)
+		t.publishEnd(err)
+		notifier.transferEnded(t, err)
+		if err != nil || status != http.StatusOK {
+			detachedDownloads.WithLabelValues("failed").Inc()
+			logger.Error("Background download failed", "path", path, "status", status, "error", err)
+			m.remove(uri, d)
+			return
+		}
+		detachedDownloads.WithLabelValues("completed").Inc()
+		logger.Info("Background download completed", "path", path, "keep", m.ttl)
+		time.AfterFunc(m.ttl, func() { m.remove(uri, d) })
+	}()
+	return d, nil
+}
+
+func (m *downloadManager) remove(uri string, d *download) {
+	m.mu.Lock()
+	if m.downloads[uri] == d {
+		delete(m.downloads, uri)
+	}
+	m.mu.Unlock()
+	d.release()
+}
+
+// serve answers r from the background download of its path and query,
+// honouring a single-range Range header once the total size is known.
+func (m *downloadManager) serve(r *http.Request, hj http.Hijacker, w http.ResponseWriter) error {
+	ctx := r.Context()
+	d, err := m.acquire(ctx, r.URL.RequestURI())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	defer d.release()
+
+	status, header, err := d.waitHeader(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return abandon(ctx, 0)
+		}
+		http.Error(w, fmt.Sprintf("Bad Gateway: %v", err), http.StatusBadGateway)
+		return err
+	}
+
+	var start, end int64 = 0, -1
+	for key, values := range header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	total, lengthErr := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if status == http.StatusOK && lengthErr == nil {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			var ok bool
+			start, end, ok = parseByteRange(rangeHeader, total)
+			if !ok {
+				w.Header().Del("Content-Length")
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+				http.Error(w, "Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+				return nil
+			}
+			loggerFrom(ctx).Info("Serving range of background download", "start", start, "end", end, "download_id", d.id)
+			status = http.StatusPartialContent
+			w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+		}
+	}
+	w.WriteHeader(status)
+
+	// A file of its own lets the client connection sendfile from it
+	cache, err := os.Open(d.file.Name())
+	if err != nil {
+		return fmt.Errorf("Error opening cache file: %v\n", err)
+	}
+	defer cache.Close()
+	if _, err := cache.Seek(start, io.SeekStart); err != nil {
+		return fmt.Errorf("Error reading cache file: %v\n", err)
+	}
+	limits := bandwidth.acquire(ctx)
+	defer limits.release()
+	for offset := start; end < 0 || offset <= end; {
+		available, err := d.waitData(ctx, offset)
+		if available <= offset {
+			if err == nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return abandon(ctx, 0)
+			}
+			// The download failed before reaching the requested bytes.
+			// Close the connection so the client sees a truncated response.
+			conn, _, hjErr := hj.Hijack()
+			if hjErr != nil {
+				return hjErr
+			}
+			_ = conn.Close()
+			transferFrom(ctx).setOutcome(outcomeTruncated)
+			return err
+		}
+
+		chunk := min(available-offset, fastPathChunk)
+		if !limits.unlimited() {
+			chunk = min(chunk, int64(buffers.size)) // Smooth, like a buffered copy
+		}
+		if end >= 0 {
+			chunk = min(chunk, end-offset+1)
+		}
+		err = limits.waitClient(ctx, int(chunk))
+		if err == nil {
+			var n int64
+			n, err = io.CopyN(w, cache, chunk)
+			offset += n
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return abandon(ctx, 0)
+			}
+			transferFrom(ctx).setOutcome(outcomeAborted)
+			return fmt.Errorf("Error sending cache file to client: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// parseByteRange parses a single-range Range header against a representation
+// of total bytes and returns the inclusive first and last byte positions.
+func parseByteRange(rangeHeader string, total int64) (int64, int64, bool) {
+	var start, end int64
+	if n, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end); err == nil && n == 2 {
+		end = min(end, total-1)
+	} else if n, err := fmt.Sscanf(rangeHeader, "bytes=%d-", &start); err == nil && n == 1 {
+		end = total - 1
+	} else if n, err := fmt.Sscanf(rangeHeader, "bytes=-%d", &end); err == nil && n == 1 {
+		start = max(0, total-end)
+		end = total - 1
+	} else {
+		return 0, 0, false
+	}
+	if start < 0 || start > end || start >= total {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// download is a background transfer into a local file. It implements
+// http.ResponseWriter and http.Hijacker so that resilientGet can drive it
+// exactly like a client connection.
+type download struct {
+	id   string
+	file *os.File
+
+	mu       sync.Mutex
+	changed  chan struct{} // closed and replaced on every state change
+	pending  http.Header
+	header   http.Header
+	status   int
+	size     int64
+	done     bool
+	err      error
+	refs     int
+	rejected bool
+}
+
+func newDownload(id string, file *os.File) *download {
+	return &download{
+		id:      id,
+		file:    file,
+		changed: make(chan struct{}),
+		pending: make(http.Header),
+		refs:    1, // held by the manager until the entry is removed
+	}
+}
+
+func (d *download) acquire() {
+	d.mu.Lock()
+	d.refs++
+	d.mu.Unlock()
+}
+
+// release drops a reference and deletes the local copy once nobody uses it.
+func (d *download) release() {
+	d.mu.Lock()
+	d.refs--
+	last := d.refs == 0
+	d.mu.Unlock()
+	if last {
+		d.file.Close()
+		os.Remove(d.file.Name())
+	}
+}
+
+// notify wakes up all readers. It must be called with d.mu held.
+func (d *download) notify() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+func (d *download) Header() http.Header {
+	return d.pending
+}
+
+func (d *download) WriteHeader(statusCode int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.status != 0 {
+		// resilientGet reports a failure after the headers went out by
+		// writing a second status; everything after it is not content.
+		d.rejected = true
+		return
+	}
+	d.status = statusCode
+	d.header = d.pending.Clone()
+	d.notify()
+}
+
+func (d *download) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	if d.status == 0 {
+		d.mu.Unlock()
+		d.WriteHeader(http.StatusOK)
+		d.mu.Lock()
+	}
+	rejected := d.rejected
+	d.mu.Unlock()
+	if rejected {
+		return len(p), nil
+	}
+
+	n, err := d.file.Write(p)
+	d.mu.Lock()
+	d.size += int64(n)
+	d.notify()
+	d.mu.Unlock()
+	return n, err
+}
+
+// Hijack is only called by resilientGet to close the connection of a
+// transfer whose content changed upstream or that was cut off after the
+// headers went out. There is no connection to hand out: a content change ends
+// the download with the error, a cut-off transfer then writes a second status.
+func (d *download) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, errDownloadContentChanged
+}
+
+// finish marks the download as done and returns the upstream status and the
+// error it ended with.
+func (d *download) finish(err error) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil && d.rejected {
+		err = errors.New("upstream transfer failed")
+	}
+	if err == nil && d.status == 0 {
+		err = errors.New("upstream sent no response")
+	}
+	d.done = true
+	d.err = err
+	d.notify()
+	return d.status, err
+}
+
+// waitHeader blocks until the upstream response headers are known.
+func (d *download) waitHeader(ctx context.Context) (int, http.Header, error) {
+	for {
+		d.mu.Lock()
+		status, header, done, err, changed := d.status, d.header, d.done, d.err, d.changed
+		d.mu.Unlock()
+		if status != 0 {
+			return status, header, nil
+		}
+		if done {
+			return 0, nil, err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		}
+	}
+}
+
+// waitData blocks until more than offset bytes are available or the download
+// is over. It returns the number of bytes available and, once no more will
+// arrive, the error the download ended with (nil when it completed).
+func (d *download) waitData(ctx context.Context, offset int64) (int64, error) {
+	for {
+		d.mu.Lock()
+		size, done, err, changed := d.size, d.done, d.err, d.changed
+		d.mu.Unlock()
+		if size > offset {
+			return size, nil
+		}
+		if done {
+			return size, err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return size, ctx.Err()
+		}
+	}
+}
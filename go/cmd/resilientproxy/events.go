@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer lifecycle event types
+const (
+	eventStarted        = "started"         // The transfer was registered
+	eventHeaders        = "headers"         // The response headers were sent to the client
+	eventProgress       = "progress"        // Periodic tick while body bytes are sent
+	eventUpstreamError  = "upstream_error"  // An upstream request or read failed
+	eventRetryScheduled = "retry_scheduled" // The next upstream request waits for Delay
+	eventResumed        = "resumed"         // The upstream request was reissued at Offset
+	eventCompleted      = "completed"       // The whole response was sent
+	eventAborted        = "aborted"         // The transfer ended otherwise, see Outcome
+)
+
+const (
+	progressInterval  = time.Second      // Minimum time between progress events of a transfer
+	eventBufferSize   = 256              // Events buffered per subscriber before dropping
+	heartbeatInterval = 15 * time.Second // Keeps idle event streams open through intermediaries
+)
+
+// transferEvent is a step in the life of a transfer. Fields that do not apply
+// to an event type are omitted.
+type transferEvent struct {
+	Type          string        `json:"type"`
+	Time          time.Time     `json:"time"`
+	TransferID    uint64        `json:"transfer_id"`
+	RequestID     string        `json:"request_id"`
+	Path          string        `json:"path"`
+	Route         string        `json:"route"`
+	BytesSent     int64         `json:"bytes_sent"`
+	Status        int           `json:"status,omitempty"`
+	ContentLength int64         `json:"content_length,omitempty"`
+	Attempt       int           `json:"attempt,omitempty"`
+	Delay         time.Duration `json:"delay_ns,omitempty"`
+	Offset        int64         `json:"offset,omitempty"`
+	Error         string        `json:"error,omitempty"`
+	Outcome       string        `json:"outcome,omitempty"`
+}
+
+// eventBus fans transfer events out to subscribers. Publishing never blocks:
+// a subscriber that falls behind loses events rather than slowing transfers.
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan transferEvent]func(*transferEvent) bool
+	count       atomic.Int32
+}
+
+var transferEvents = &eventBus{subscribers: make(map[chan transferEvent]func(*transferEvent) bool)}
+
+// subscribe returns a channel receiving the events accepted by filter and a
+// function to cancel the subscription.
+func (bus *eventBus) subscribe(filter func(*transferEvent) bool) (<-chan transferEvent, func()) {
+	ch := make(chan transferEvent, eventBufferSize)
+	bus.mu.Lock()
+	bus.subscribers[ch] = filter
+	bus.count.Add(1)
+	bus.mu.Unlock()
+	return ch, func() {
+		bus.mu.Lock()
+		delete(bus.subscribers, ch)
+		bus.count.Add(-1)
+		bus.mu.Unlock()
+	}
+}
+
+func (bus *eventBus) publish(e transferEvent) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for ch, filter := range bus.subscribers {
+		if !filter(&e) {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publish sends an event of the given type for t. set fills in the fields
+// specific to the type; it is only called if someone is listening.
+func (t *transfer) publish(typ string, set func(*transferEvent)) {
+	if t == nil || transferEvents.count.Load() == 0 {
+		return
+	}
+	e := transferEvent{
+		Type:       typ,
+		Time:       time.Now(),
+		TransferID: t.id,
+		RequestID:  t.requestID,
+		Path:       t.path,
+		Route:      t.route,
+		BytesSent:  t.bytesSent.Load(),
+	}
+	if set != nil {
+		set(&e)
+	}
+	transferEvents.publish(e)
+}
+
+// publishEnd sends the completed or aborted event of a transfer that ended
+// with err.
+func (t *transfer) publishEnd(err error) {
+	outcome := t.getOutcome(err)
+	typ := eventAborted
+	if outcome == outcomeComplete {
+		typ = eventCompleted
+	}
+	t.publish(typ, func(e *transferEvent) {
+		e.Status = int(t.status.Load())
+		e.Outcome = outcome
+		if err != nil {
+			e.Error = err.Error()
+		}
+	})
+}
+
+// eventsHandler streams transfer events as Server-Sent Events, or as
+// newline-delimited JSON with ?format=ndjson. The events can be limited to a
+// request with ?request_id= or to paths starting with ?prefix=.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	requestID, prefix := r.URL.Query().Get("request_id"), r.URL.Query().Get("prefix")
+	ndjson := r.URL.Query().Get("format") == "ndjson"
+
+	events, unsubscribe := transferEvents.subscribe(func(e *transferEvent) bool {
+		return (requestID == "" || e.RequestID == requestID) && strings.HasPrefix(e.Path, prefix)
+	})
+	defer unsubscribe()
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e := <-events:
+			data, _ := json.Marshal(e)
+			var err error
+			if ndjson {
+				_, err = fmt.Fprintf(w, "%s\n", data)
+			} else {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			}
+			if err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			var err error
+			if ndjson {
+				_, err = fmt.Fprintln(w)
+			} else {
+				_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			}
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import "io"
+
+// fastPathChunk is the most a fast-path copy moves before the transfer's
+// progress is recorded.
+const fastPathChunk = 4 << 20
+
+// fastPath enables copying plain-HTTP responses without bandwidth limits with
+// io.Copy, so writers down to the client connection can use ReadFrom and the
+// runtime splice or sendfile where the source allows it. An upstream body is
+// no socket the runtime could splice from, so it still passes through a
+// buffer, just not ours; BenchmarkPassthrough measures no gain, so it is off
+// unless -fastPath is given. Files of the disk cache always go out with
+// sendfile.
+var fastPath bool
+
+// useFastPath reports whether a response fetched over scheme may be copied
+// on the fast path to a client connected with or without TLS.
+func useFastPath(scheme string, clientTLS bool, limits *transferBandwidth) bool {
+	return fastPath && scheme == "http" && !clientTLS && limits.unlimited()
+}
+
+// copyChunk copies up to fastPathChunk bytes of body to w, through w's
+// ReadFrom if it has one and through buffer otherwise. It returns the bytes
+// written and tells the error reading body, io.EOF at its end, from the
+// error writing to w.
+func copyChunk(w io.Writer, body io.Reader, buffer []byte) (n int64, readErr, writeErr error) {
+	src := &errorRecorder{Reader: body}
+	n, err := io.CopyBuffer(w, io.LimitReader(src, fastPathChunk), buffer)
+	switch {
+	case src.err == io.EOF && err != nil:
+		return n, nil, err // io.Copy hides io.EOF, so err is from writing
+	case src.err != nil:
+		return n, src.err, nil // A ReadFrom may have wrapped it
+	default:
+		return n, nil, err
+	}
+}
+
+// errorRecorder remembers the error its reader returned, which io.Copy does
+// not pass on for io.EOF.
+type errorRecorder struct {
+	io.Reader
+	err error
+}
+
+func (r *errorRecorder) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// readFrom copies src to w, through w's ReadFrom if it has one.
+func readFrom(w io.Writer, src io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(struct{ io.Writer }{w}, src)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// failingWriter accepts limit bytes and fails after that.
+type failingWriter struct {
+	limit int
+	buf   bytes.Buffer
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		n := w.limit - w.buf.Len()
+		w.buf.Write(p[:n])
+		return n, errors.New("connection reset")
+	}
+	return w.buf.Write(p)
+}
+
+// wrappingReaderFrom reads like a network connection, which wraps the
+// errors of its source.
+type wrappingReaderFrom struct {
+	bytes.Buffer
+}
+
+func (w *wrappingReaderFrom) ReadFrom(src io.Reader) (int64, error) {
+	n, err := w.Buffer.ReadFrom(src)
+	if err != nil {
+		err = fmt.Errorf("readfrom: %w", err)
+	}
+	return n, err
+}
+
+func TestCopyChunk(t *testing.T) {
+	buffer := make([]byte, 4)
+	var out bytes.Buffer
+	n, readErr, writeErr := copyChunk(&out, strings.NewReader("content"), buffer)
+	if n != 7 || readErr != io.EOF || writeErr != nil || out.String() != "content" {
+		t.Errorf("Expected the whole body and io.EOF, got %d %q, %v, %v", n, out.String(), readErr, writeErr)
+	}
+
+	// Bytes the client did not take are not counted
+	w := &failingWriter{limit: 5}
+	n, readErr, writeErr = copyChunk(w, strings.NewReader("content"), buffer)
+	if n != 5 || readErr != nil || writeErr == nil {
+		t.Errorf("Expected a write error after 5 bytes, got %d, %v, %v", n, readErr, writeErr)
+	}
+
+	upstreamErr := errors.New("unexpected EOF")
+	n, readErr, writeErr = copyChunk(&out, io.MultiReader(strings.NewReader("con"), iotest.ErrReader(upstreamErr)), buffer)
+	if n != 3 || readErr != upstreamErr || writeErr != nil {
+		t.Errorf("Expected a read error after 3 bytes, got %d, %v, %v", n, readErr, writeErr)
+	}
+	n, readErr, writeErr = copyChunk(&wrappingReaderFrom{}, io.MultiReader(strings.NewReader("con"), iotest.ErrReader(upstreamErr)), buffer)
+	if n != 3 || readErr != upstreamErr || writeErr != nil {
+		t.Errorf("Expected a read error wrapped by ReadFrom after 3 bytes, got %d, %v, %v", n, readErr, writeErr)
+	}
+}
+
+// BenchmarkPassthrough compares the throughput of plain-HTTP responses copied
+// through the transfer buffer and on the fast path.
+func BenchmarkPassthrough(b *testing.B) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4<<20) // 64 MiB
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+	setupLogging(io.Discard, "text", "error")
+	defer setupLogging(os.Stderr, "text", "info")
+	defer func(enabled bool) { fastPath = enabled }(fastPath)
+
+	p := &proxy{routes: newRouteTable([]*route{{name: "default", upstreams: []string{upstream.URL}, retry: defaultRetryPolicy}})}
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	for _, enabled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("fastPath=%t", enabled), func(b *testing.B) {
+			fastPath = enabled
+			b.SetBytes(int64(len(content)))
+			for b.Loop() {
+				resp, err := http.Get(front.URL + "/content")
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil || n != int64(len(content)) {
+					b.Fatalf("Expected %d bytes, got %d, %v", len(content), n, err)
+				}
+			}
+		})
+	}
+}
+
+// failingResponseWriter is a client connection that resets after limit bytes.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+	body failingWriter
+}
+
+func (w *failingResponseWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+func TestCountingWriterReadFromCountsWhatWasWritten(t *testing.T) {
+	tr := &transfer{}
+	w := &countingWriter{&failingResponseWriter{ResponseRecorder: httptest.NewRecorder(), body: failingWriter{limit: 5}}, tr}
+	n, err := w.ReadFrom(strings.NewReader("content"))
+	if n != 5 || err == nil {
+		t.Errorf("Expected a write error after 5 bytes, got %d, %v", n, err)
+	}
+	if sent := tr.bytesSent.Load(); sent != 5 {
+		t.Errorf("Expected 5 bytes counted as sent, got %d", sent)
+	}
+	if tr.status.Load() != http.StatusOK || tr.firstByte.Load() == 0 {
+		t.Errorf("Expected the status and first byte to be recorded")
+	}
+}
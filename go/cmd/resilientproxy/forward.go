@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	errPrivateAddress  = errors.New("destination is a private address")
+	errRedirectRefused = errors.New("redirect refused")
+)
+
+// forwardPolicy decides which destinations forward-proxy requests and
+// CONNECT tunnels may reach.
+type forwardPolicy struct {
+	allow        []string     // host patterns; empty allows all hosts not denied
+	deny         []string     // host patterns
+	connectPorts []string     // ports CONNECT tunnels may reach
+	allowPrivate bool         // permits loopback, private and link-local addresses
+	mitm         *interceptor // nil unless HTTPS interception is enabled
+
+	// The routes of all forward-proxy and CONNECT requests, which share
+	// one upstream transport
+	forward, connect *route
+}
+
+// newForwardPolicy parses comma-separated host patterns such as
+// "example.com,*.example.org" and a comma-separated list of ports.
+func newForwardPolicy(allow, deny, connectPorts string, allowPrivate bool) *forwardPolicy {
+	split := func(list string) []string {
+		var patterns []string
+		for _, pattern := range strings.Split(list, ",") {
+			if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+		return patterns
+	}
+	fp := &forwardPolicy{allow: split(allow), deny: split(deny), connectPorts: split(connectPorts), allowPrivate: allowPrivate}
+	fp.forward = &route{name: "forward", retry: defaultRetryPolicy, dialer: fp.dialer(), forward: true, checkRedirect: fp.checkRedirect}
+	fp.connect = &route{name: "connect", forward: true}
+	return fp
+}
+
+// check returns an error if host may not be reached. Unless private
+// addresses are allowed, it resolves host so a request for a name pointing
+// into the internal network is refused before anything is sent.
+func (fp *forwardPolicy) check(ctx context.Context, host string) error {
+	host = strings.ToLower(host)
+	for _, pattern := range fp.deny {
+		if hostMatches(pattern, host) {
+			return fmt.Errorf("destination %s is denied", host)
+		}
+	}
+	allowed := len(fp.allow) == 0
+	for _, pattern := range fp.allow {
+		allowed = allowed || hostMatches(pattern, host)
+	}
+	if !allowed {
+		return fmt.Errorf("destination %s is not allowed", host)
+	}
+	if fp.allowPrivate {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if isPrivateIP(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", errPrivateAddress, host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// checkRedirect applies the policy to each redirect a forward-proxy request
+// follows, not only to the destination the client named.
+func (fp *forwardPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("%w: stopped after 10 redirects", errRedirectRefused)
+	}
+	if err := fp.check(req.Context(), req.URL.Hostname()); err != nil {
+		return fmt.Errorf("%w: %v", errRedirectRefused, err)
+	}
+	return nil
+}
+
+// dialer returns the dialer for connections to forward-proxy destinations.
+// Unless private addresses are allowed, it refuses to connect to them, which
+// also catches names re-resolving to a different address after check.
+func (fp *forwardPolicy) dialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !fp.allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return fmt.Errorf("%w: %s", errPrivateAddress, host)
+			}
+			return nil
+		}
+	}
+	return dialer
+}
+
+// carrierGradeNAT is the shared address space of RFC 6598.
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || carrierGradeNAT.Contains(ip)
+}
+
+// route returns the route of a forward-proxy request: an absolute-form
+// request goes to the origin named in its URI, a CONNECT request is tunnelled.
+func (fp *forwardPolicy) route(r *http.Request) *route {
+	if r.Method == http.MethodConnect {
+		return fp.connect
+	}
+	return fp.forward
+}
+
+// serve serves an absolute-form request with the same resume logic as any
+// other request.
+func (fp *forwardPolicy) serve(r *http.Request, rt *route, hj http.Hijacker, w http.ResponseWriter) error {
+	if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+		err := fmt.Errorf("unsupported scheme %q", r.URL.Scheme)
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		transferFrom(r.Context()).setOutcome(outcomeFailed)
+		return err
+	}
+	if err := fp.check(r.Context(), r.URL.Hostname()); err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		transferFrom(r.Context()).setOutcome(outcomeFailed)
+		return err
+	}
+	return resilientGet(r, r.URL.Scheme+"://"+r.URL.Host, hj, w)
+}
+
+// tunnel serves a CONNECT request by relaying bytes between the client and
+// the destination without looking at them. Tunnels to intercepted hosts are
+// terminated instead and the requests inside passed to handler.
+func (fp *forwardPolicy) tunnel(r *http.Request, hj http.Hijacker, w http.ResponseWriter, handler http.Handler) error {
+	ctx := r.Context()
+	t := transferFrom(ctx)
+	logger := loggerFrom(ctx)
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, "Bad Request: CONNECT needs host:port", http.StatusBadRequest)
+		t.setOutcome(outcomeFailed)
+		return err
+	}
+	// A tunnel carries any protocol, so only to the ports meant for TLS
+	if !slices.Contains(fp.connectPorts, port) {
+		err := fmt.Errorf("CONNECT to port %s is not allowed", port)
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		t.setOutcome(outcomeFailed)
+		return err
+	}
+	if err := fp.check(ctx, host); err != nil {
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		t.setOutcome(outcomeFailed)
+		return err
+	}
+
+	if fp.mitm.intercepts(host) {
+		conn, buffered, err := hj.Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := establish(ctx, conn); err != nil {
+			return err
+		}
+		logger.Info("Intercepting tunnel", "destination", r.Host)
+		fp.mitm.serve(ctx, &bufferedConn{Conn: conn, reader: buffered.Reader}, r.Host, handler)
+		t.setOutcome(outcomeComplete)
+		return nil
+	}
+
+	t.setUpstreamURL(r.Host)
+	t.countAttempt()
+	upstream, err := fp.dialer().DialContext(ctx, "tcp", r.Host)
+	if err != nil {
+		t.setLastError(err)
+		status := http.StatusBadGateway
+		if errors.Is(err, errPrivateAddress) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(status), err), status)
+		t.setOutcome(outcomeFailed)
+		return err
+	}
+	defer upstream.Close()
+
+	conn, buffered, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := establish(ctx, conn); err != nil {
+		return err
+	}
+	logger.Info("Tunnel established", "destination", r.Host)
+
+	// The client may have sent bytes after the CONNECT request that are
+	// already buffered, so read them through buffered.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, buffered)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		upstream.Close()
+	})
+	defer stop()
+	n, err := io.Copy(conn, upstream)
+	t.bytesSent.Add(n)
+	conn.Close()
+	wg.Wait()
+	logger.Info("Tunnel closed", "destination", r.Host, "bytes", n)
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	t.setOutcome(outcomeComplete)
+	return err
+}
+
+// establish tells the client on the hijacked conn that its tunnel is open.
+func establish(ctx context.Context, conn net.Conn) error {
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 200 Connection Established\r\n%s: %s\r\n\r\n", requestIDHeader, requestIDFrom(ctx)); err != nil {
+		return err
+	}
+	transferFrom(ctx).status.Store(http.StatusOK)
+	return nil
+}
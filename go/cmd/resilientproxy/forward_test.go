@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestForwardPolicy(t *testing.T) {
+	fp := newForwardPolicy("*.example.com, 127.0.0.1", "secret.example.com", "443", false)
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"secret.example.com", false},
+		{"example.org", false},
+		{"127.0.0.1", false}, // Allowed, but a private address
+		{"10.1.2.3", false},
+		{"100.64.0.1", false},
+	}
+	for _, tt := range tests {
+		if err := fp.check(context.Background(), tt.host); (err == nil) != tt.allowed {
+			t.Errorf("check(%s) = %v, want allowed %v", tt.host, err, tt.allowed)
+		}
+	}
+	if err := fp.check(context.Background(), "127.0.0.1"); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("check(127.0.0.1) = %v, want %v", err, errPrivateAddress)
+	}
+
+	fp.allowPrivate = true
+	if err := fp.check(context.Background(), "127.0.0.1"); err != nil {
+		t.Errorf("check(127.0.0.1) with private addresses allowed = %v", err)
+	}
+	if err := fp.check(context.Background(), "DL.Example.com"); err != nil {
+		t.Errorf("check(DL.Example.com) = %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// version is the release of the binary, set at build time with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// Readiness checks
+const (
+	readyCircuit = "circuit" // Ready unless an upstream's circuit is open
+	readyProbe   = "probe"   // Ready if every upstream answers a HEAD request
+	readyNone    = "none"    // Always ready
+)
+
+// readiness reports whether the upstreams are reachable.
+type readiness struct {
+	upstreams []string
+	transport func(upstream string) *http.Transport
+	check     string
+	timeout   time.Duration // for each probe
+}
+
+func newReadiness(upstreams []string, transport func(string) *http.Transport, check string, timeout time.Duration) (*readiness, error) {
+	switch check {
+	case readyCircuit, readyProbe, readyNone:
+	default:
+		return nil, fmt.Errorf("unknown readiness check %q, expected %s, %s or %s", check, readyCircuit, readyProbe, readyNone)
+	}
+	return &readiness{upstreams: upstreams, transport: transport, check: check, timeout: timeout}, nil
+}
+
+// upstreamStatus is the readiness of one upstream.
+type upstreamStatus struct {
+	Upstream string `json:"upstream"`
+	Ready    bool   `json:"ready"`
+	Circuit  string `json:"circuit"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ServeHTTP answers 200 if all upstreams pass the check and 503 otherwise,
+// with the status of each upstream as JSON.
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]upstreamStatus, len(rd.upstreams))
+	var wg sync.WaitGroup
+	for i, upstream := range rd.upstreams {
+		statuses[i] = upstreamStatus{Upstream: upstream, Ready: true, Circuit: upstreamCircuits.state(upstream)}
+		switch rd.check {
+		case readyCircuit:
+			if statuses[i].Circuit == circuitOpen {
+				statuses[i].Ready, statuses[i].Error = false, "circuit open"
+			}
+		case readyProbe:
+			wg.Add(1)
+			go func(status *upstreamStatus) {
+				defer wg.Done()
+				if err := rd.probe(r.Context(), status.Upstream); err != nil {
+					status.Ready, status.Error = false, err.Error()
+				}
+			}(&statuses[i])
+		}
+	}
+	wg.Wait()
+
+	ready := true
+	for _, status := range statuses {
+		ready = ready && status.Ready
+	}
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, struct {
+		Ready     bool             `json:"ready"`
+		Check     string           `json:"check"`
+		Upstreams []upstreamStatus `json:"upstreams"`
+	}{ready, rd.check, statuses})
+}
+
+// probe sends a HEAD request to upstream. Any response short of a server
+// error counts as reachable.
+func (rd *readiness) probe(ctx context.Context, upstream string) error {
+	ctx, cancel := context.WithTimeout(ctx, rd.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, upstream, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: rd.transport(upstream)} // Like the proxied requests
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("upstream server returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// versionHandler reports the build information of the binary.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	info := struct {
+		Version   string `json:"version"`
+		GoVersion string `json:"go_version"`
+		Platform  string `json:"platform"`
+		Module    string `json:"module,omitempty"`
+		Revision  string `json:"revision,omitempty"`
+		Time      string `json:"time,omitempty"`
+		Modified  bool   `json:"modified,omitempty"`
+	}{Version: version, GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		info.Module = build.Main.Path
+		if version == "dev" && build.Main.Version != "" && build.Main.Version != "(devel)" {
+			info.Version = build.Main.Version
+		}
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Revision = setting.Value
+			case "vcs.time":
+				info.Time = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, info)
+}
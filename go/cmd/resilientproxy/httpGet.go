@@ -1,49 +1,132 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Retry logic with range support
-func fetchWithRetry(baseURL, verb string, path string, retries int, rangeHeader string) (*http.Response, error) {
+func fetchWithRetry(ctx context.Context, baseURL, verb string, path string, retries int, rangeHeader string) (*http.Response, error) {
 	var lastErr error
-	fullURL := fmt.Sprintf("%s%s", baseURL, path) // Append the requested path to the upstream URL
-	logUpstream("Fetching URL: %s\n", fullURL)
+	var fullURL string
+	var shownURL string // fullURL without the query, which may hold a signature
+	var logger *slog.Logger
+	var waited time.Duration
+	policy := retryPolicyFrom(ctx)
 	for attempt := 1; attempt <= retries; attempt++ {
-		req, err := http.NewRequest(verb, fullURL, nil)
+		// A route with several upstreams fails over once a circuit opens
+		upstream := upstreamFor(ctx, baseURL)
+		target := upstream + path // Append the requested path to the upstream URL
+		if signed := transferFrom(ctx).getSignedURL(); signed != "" {
+			target = signed
+			if u, err := url.Parse(signed); err == nil {
+				upstream = u.Scheme + "://" + u.Host
+			}
+		}
+		if target != fullURL {
+			fullURL = target
+			shownURL = redactQuery(fullURL)
+			logger = loggerFrom(ctx).With("method", verb, "url", shownURL)
+			logger.Info("Fetching from upstream", "range", rangeHeader)
+			transferFrom(ctx).setUpstreamURL(shownURL)
+		}
+		attrs := []attribute.KeyValue{
+			attribute.String("http.request.method", verb),
+			attribute.String("url.full", shownURL),
+			attribute.Int("http.request.resend_count", attempt-1),
+			attribute.Int64("resilientproxy.backoff_waited_ms", waited.Milliseconds()),
+		}
+		if rangeHeader != "" {
+			attrs = append(attrs, attribute.String("http.request.header.range", rangeHeader))
+		}
+		attemptCtx, span := tracer.Start(ctx, "upstream "+verb, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+
+		req, err := http.NewRequestWithContext(attemptCtx, verb, fullURL, nil)
 		if err != nil {
+			endSpan(span, err)
 			return nil, err
 		}
+		if id := requestIDFrom(ctx); id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		otel.GetTextMapPropagator().Inject(attemptCtx, propagation.HeaderCarrier(req.Header))
 
 		// Add Range header if provided
 		if rangeHeader != "" {
 			req.Header.Set("Range", rangeHeader)
 		}
+		rt := routeFrom(ctx)
+		var creds *credentials
+		if rt != nil {
+			rt.requestHeaders.apply(req.Header)
+			creds = rt.credentials
+		}
 
-		client := &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true, // Disable certificate verification
-				},
-			},
+		// The slot is held until the response body is closed
+		release, err := upstreamSlots.acquire(attemptCtx, req.URL.Host, transferFrom(ctx).clientKey())
+		if err != nil {
+			endSpan(span, context.Cause(ctx))
+			return nil, context.Cause(ctx)
 		}
-		resp, err := client.Do(req)
-		if err == nil && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent) {
-			// Log headers line by line
-			for key, values := range resp.Header {
-				logUpstream("%s: %s\n", key, values)
+		client := &http.Client{Transport: rt.transport()}
+		if rt != nil {
+			client.CheckRedirect = rt.checkRedirect
+		}
+		transferFrom(ctx).countAttempt()
+		resp, err := creds.send(client, req)
+		if err != nil {
+			release()
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				urlErr.URL = shownURL
 			}
+		} else {
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+		}
+		// Forward-proxy destinations are too many to track
+		if ctx.Err() == nil && (rt == nil || !rt.forward) {
+			if err != nil {
+				upstreamCircuits.record(upstream, err)
+			} else if resp.StatusCode >= 500 {
+				upstreamCircuits.record(upstream, fmt.Errorf("upstream server returned status: %d", resp.StatusCode))
+			} else {
+				upstreamCircuits.record(upstream, nil)
+			}
+		}
+		if err == nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		if err == nil && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent) {
+			upstreamAttempts.WithLabelValues("success").Inc()
+			logger.Debug("Upstream responded", "attempt", attempt, "status", resp.StatusCode)
+			logHeaders(ctx, logger, "Upstream response header", resp.Header)
+			resp.Body = &tracedBody{ReadCloser: resp.Body, span: span}
 			return resp, nil
 		} else if err == nil && resp.StatusCode >= 400 && resp.StatusCode < 550 {
+			upstreamAttempts.WithLabelValues("error_status").Inc()
+			logger.Warn("Upstream returned an error status", "attempt", attempt, "status", resp.StatusCode)
+			resp.Body = &tracedBody{ReadCloser: resp.Body, span: span}
 			return resp, nil
 		}
+		upstreamAttempts.WithLabelValues("retry").Inc()
 		// Handle client errors (4xx) and server errors (5xx
+		if ctx.Err() != nil {
+			endSpan(span, context.Cause(ctx))
+			return nil, context.Cause(ctx)
+		}
 		if err != nil {
 			lastErr = err
 		} else {
@@ -52,12 +135,25 @@ func fetchWithRetry(baseURL, verb string, path string, retries int, rangeHeader
 				resp.Body.Close()
 			}
 		}
+		endSpan(span, lastErr)
+		transferFrom(ctx).setLastError(lastErr)
+		transferFrom(ctx).publish(eventUpstreamError, func(e *transferEvent) {
+			e.Attempt = attempt
+			e.Error = lastErr.Error()
+		})
 
+		if !retryable(lastErr) {
+			return nil, lastErr
+		}
 		if attempt < retries {
-			sleepTime := min(60, (attempt)*(attempt))
-			logUpstream("Retrying in %d seconds\n", sleepTime)
-			time.Sleep(retryDelay * time.Duration(sleepTime))
-			logUpstream("Retrying... (%d/%d)\n", attempt, retries)
+			delay := policy.backoff(attempt)
+			logger.Warn("Upstream request failed, retrying", "attempt", attempt, "retries", retries, "delay", delay, "error", lastErr)
+			publishRetry(ctx, attempt, delay)
+			sleepStart := time.Now()
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, err
+			}
+			waited = time.Since(sleepStart)
 			continue
 		}
 	}
@@ -65,7 +161,14 @@ func fetchWithRetry(baseURL, verb string, path string, retries int, rangeHeader
 }
 
 // Check the client's Range request and determine if ranges are supported by the upstream server
-func checkClientRangeRequest(r *http.Request, bytesSent *int64, end *int64, length *int64, savedETag *string, savedLastModified *string, upstream string) (bool, error) {
+func checkClientRangeRequest(r *http.Request, bytesSent *int64, end *int64, length *int64, savedETag *string, savedLastModified *string, upstream string) (rangesPossible bool, err error) {
+	logger := loggerFrom(r.Context())
+	ctx, span := tracer.Start(r.Context(), "range capability probe", trace.WithAttributes(
+		attribute.String("http.request.header.range", r.Header.Get("Range"))))
+	defer func() {
+		span.SetAttributes(attribute.Bool("resilientproxy.ranges_supported", rangesPossible))
+		endSpan(span, err)
+	}()
 
 	lengthHeader := r.Header.Get("Content-Length")
 	if lengthHeader != "" {
@@ -74,14 +177,14 @@ func checkClientRangeRequest(r *http.Request, bytesSent *int64, end *int64, leng
 		if err != nil {
 			return false, fmt.Errorf("invalid Content-Length header: %s", lengthHeader)
 		}
-		log.Printf("Received Content-Length header: %d\n", *length)
+		logger.Debug("Received Content-Length header", "length", *length)
 	} else {
-		log.Printf("No Content-Length header present. Assuming unknown length.\n")
+		logger.Debug("No Content-Length header present. Assuming unknown length.")
 	}
 
 	rangeHeader := r.Header.Get("Range")
 	if rangeHeader != "" {
-		log.Printf("Rceived Range header: %s\n", rangeHeader)
+		logger.Debug("Received Range header", "range", rangeHeader)
 
 		// Validate the Range header format
 		if len(rangeHeader) < 6 || rangeHeader[:6] != "bytes=" {
@@ -97,7 +200,7 @@ func checkClientRangeRequest(r *http.Request, bytesSent *int64, end *int64, leng
 			if err == nil && n == 1 {
 				*bytesSent = start
 				*end = -1 // End is unspecified
-				log.Printf("Parsed Range header: start=%d, end=unspecified\n", start)
+				logger.Debug("Parsed Range header", "start", start, "end", "unspecified")
 			} else {
 				// Handle cases like "bytes=-end"
 				n, err = fmt.Sscanf(rangeHeader, "bytes=-%d", end)
@@ -106,10 +209,10 @@ func checkClientRangeRequest(r *http.Request, bytesSent *int64, end *int64, leng
 				}
 				start = 0
 				*bytesSent = 0 // Start from the beginning since no start value is specified
-				log.Printf("Parsed Range header: start=unspecified, end=%d\n", *end)
+				logger.Debug("Parsed Range header", "start", "unspecified", "end", *end)
 			}
 		} else {
-			log.Printf("Parsed Range header: start=%d, end=%d\n", start, *end)
+			logger.Debug("Parsed Range header", "start", start, "end", *end)
 			if *end < start {
 				return false, fmt.Errorf("invalid Range header: end (%d) is less than start (%d)", *end, start)
 			}
@@ -122,12 +225,14 @@ func checkClientRangeRequest(r *http.Request, bytesSent *int64, end *int64, leng
 		}
 
 		// Perform a HEAD request to check range support
-		checkResp, err := fetchWithRetry(upstream, "HEAD", r.URL.Path, 1, rangeHeader)
+		checkResp, err := fetchWithRetry(ctx, upstream, "HEAD", r.URL.RequestURI(), 1, rangeHeader)
 		if err != nil {
-			logUpstream("unable to check range support: %v\n", err)
+			if r.Context().Err() != nil {
+				return false, err
+			}
 			tempRangeHeader := fmt.Sprintf("bytes=%d-%d", *bytesSent, *bytesSent+1024)
-			logUpstream("check range support with GET Request: %s\n", tempRangeHeader)
-			checkResp, err = fetchWithRetry(upstream, "GET", r.URL.Path, 1, tempRangeHeader)
+			logger.Info("Unable to check range support with HEAD, trying GET", "range", tempRangeHeader, "error", err)
+			checkResp, err = fetchWithRetry(ctx, upstream, "GET", r.URL.RequestURI(), 1, tempRangeHeader)
 			if err != nil {
 				return false, fmt.Errorf("unable to check range support: %v", err)
 			}
@@ -138,12 +243,12 @@ func checkClientRangeRequest(r *http.Request, bytesSent *int64, end *int64, leng
 			acceptRanges := checkResp.Header.Get("Accept-Ranges")
 			contentRange := checkResp.Header.Get("Content-Range")
 			if acceptRanges == "bytes" || contentRange != "" {
-				logUpstream("Upstream server supports range requests.")
+				logger.Info("Upstream server supports range requests")
 				*savedETag = checkResp.Header.Get("ETag")
 				*savedLastModified = checkResp.Header.Get("Last-Modified")
 				return TRUE_OR_SIMULATED_FALSE, nil
 			} else {
-				logUpstream("Upstream server does not support range requests.")
+				logger.Info("Upstream server does not support range requests")
 				return false, nil
 			}
 		}
@@ -151,7 +256,7 @@ func checkClientRangeRequest(r *http.Request, bytesSent *int64, end *int64, leng
 	}
 
 	// No Range header present
-	log.Printf("No Range header present. Assuming full content request.")
+	logger.Debug("No Range header present. Assuming full content request.")
 	return false, nil
 }
 
@@ -161,46 +266,121 @@ func resilientGet(r *http.Request, upstream string, hj http.Hijacker, w http.Res
 	var end int64 = -1
 	var length int64 = -1
 	var savedETag, savedLastModified string
+	var savedSize int64 = -1 // of the whole representation, -1 until known
+	var wantEnd int64 = -1   // offset the response to the client ends at, -1 if unknown
+	var headersSent bool
 	var lastUpstreamError error
+	var resigned bool // whether the latest resume attempt re-signed the URL
+	ctx := r.Context()
+	logger := loggerFrom(ctx)
+	policy := retryPolicyFrom(ctx)
+	limits := bandwidth.acquire(ctx)
+	defer limits.release()
+	buf, err := buffers.get(ctx)
+	if err != nil {
+		return abandon(ctx, 0)
+	}
+	defer buffers.put(buf)
+	buffer := *buf
 
 	// Check the client's Range request
 	rangesPossible, err := checkClientRangeRequest(r, &start, &end, &length, &savedETag, &savedLastModified, upstream)
 	if err != nil {
+		if ctx.Err() != nil {
+			return abandon(ctx, 0)
+		}
 		rangesPossible = false
 		lastUpstreamError = err
 	}
 
 	// Retry logic for streaming errors
-	for attempt := 1; attempt <= maxRetries; attempt++ {
+	for attempt := 1; attempt <= policy.maxRetries; attempt++ {
 		rangeHeader := ""
+		if bytesSent > max(start, 0) {
+			transferFrom(ctx).countResume()
+			transferFrom(ctx).publish(eventResumed, func(e *transferEvent) {
+				e.Attempt = attempt
+				e.Offset = bytesSent
+			})
+			if rangesPossible {
+				resumesTotal.WithLabelValues("range").Inc()
+			} else {
+				resumesTotal.WithLabelValues("full").Inc()
+			}
+		}
 		if rangesPossible && bytesSent > 0 {
 			if end > start {
 				rangeHeader = fmt.Sprintf("bytes=%d-%d", bytesSent, end) // Request remaining bytes
 			} else {
 				rangeHeader = fmt.Sprintf("bytes=%d-", bytesSent) // Request remaining bytes
 			}
-			log.Printf("Requesting range: %s\n", rangeHeader)
+			logger.Info("Requesting range", "range", rangeHeader, "attempt", attempt)
 		} else if rangesPossible && bytesSent == 0 {
 			rangeHeader = r.Header.Get("Range") // Request the initial range
-			log.Printf("Requesting range: %s\n", rangeHeader)
+			logger.Info("Requesting range", "range", rangeHeader, "attempt", attempt)
 		} else {
-			log.Printf("No range requested. Sending full content.\n")
+			logger.Info("No range requested. Sending full content.", "attempt", attempt)
 		}
 
-		resp, err := fetchWithRetry(upstream, "GET", r.URL.Path, maxRetries, rangeHeader) // Pass the requested path and range
+		// A reconnect requested through the admin API ends upstreamCtx,
+		// cutting short the current request or backoff wait.
+		upstreamCtx := upstreamContext(ctx)
+		resp, err := fetchWithRetry(upstreamCtx, upstream, "GET", r.URL.RequestURI(), policy.maxRetries, rangeHeader) // Pass the requested path and range
 		if err != nil {
+			if ctx.Err() != nil {
+				return abandon(ctx, attempt)
+			}
 			lastUpstreamError = err
-			log.Printf("Error fetching from upstream (attempt %d): %v\n", attempt, err)
-			if attempt < maxRetries {
-				log.Printf("Retrying fetch... (%d/%d)\n", attempt, maxRetries)
-				sleepTime := min(60, (attempt)*(attempt))
-				time.Sleep(retryDelay * time.Duration(sleepTime))
+			logger.Warn("Error fetching from upstream", "attempt", attempt, "error", err)
+			if attempt < policy.maxRetries && retryable(err) {
+				delay := policy.backoff(attempt)
+				publishRetry(ctx, attempt, delay)
+				if err := sleepContext(upstreamCtx, delay); err != nil && ctx.Err() != nil {
+					return abandon(ctx, attempt)
+				}
 				continue
 			}
 			break
 		}
 		defer resp.Body.Close()
 
+		// The pre-signed URL may have expired while the upstream was down.
+		if resp.StatusCode == http.StatusForbidden && bytesSent > max(start, 0) {
+			resp.Body.Close()
+			lastUpstreamError = fmt.Errorf("upstream server returned status: %d", resp.StatusCode)
+			if resigned {
+				logger.Error("Upstream still refuses the re-signed URL", "attempt", attempt)
+				break
+			}
+			if err := resignUpstreamURL(upstreamCtx, resp.Request.URL.String()); err != nil {
+				logger.Error("Upstream refused the resume and the URL could not be re-signed", "attempt", attempt, "error", err)
+				if ctx.Err() != nil {
+					return abandon(ctx, attempt)
+				}
+				lastUpstreamError = fmt.Errorf("%w; re-signing failed: %v", lastUpstreamError, err)
+				break
+			}
+			resigned = true
+			continue
+		}
+		resigned = false
+
+		// An error page is no continuation of what the client already has
+		if headersSent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			lastUpstreamError = fmt.Errorf("upstream server returned status: %d", resp.StatusCode)
+			logger.Warn("Upstream refused the resume", "attempt", attempt, "status", resp.StatusCode)
+			if attempt < policy.maxRetries {
+				delay := policy.backoff(attempt)
+				publishRetry(ctx, attempt, delay)
+				if err := sleepContext(upstreamCtx, delay); err != nil && ctx.Err() != nil {
+					return abandon(ctx, attempt)
+				}
+				continue
+			}
+			break
+		}
+
 		// Validate Accept-Ranges header on the first successful response
 		if attempt == 1 {
 			acceptRanges := resp.Header.Get("Accept-Ranges")
@@ -208,10 +388,10 @@ func resilientGet(r *http.Request, upstream string, hj http.Hijacker, w http.Res
 			if acceptRanges == "bytes" || contentRange != "" {
 				// FIXME
 				rangesPossible = TRUE_OR_SIMULATED_FALSE
-				logUpstream("Upstream server supports range requests.")
+				logger.Debug("Upstream server supports range requests")
 			} else {
 				rangesPossible = false
-				logUpstream("Upstream server does not support range requests.")
+				logger.Debug("Upstream server does not support range requests")
 			}
 			if start > 0 {
 				bytesSent = start
@@ -223,64 +403,47 @@ func resilientGet(r *http.Request, upstream string, hj http.Hijacker, w http.Res
 		currentLastModified := resp.Header.Get("Last-Modified")
 		if savedETag != "" && savedLastModified != "" {
 			if currentETag != savedETag || currentLastModified != savedLastModified {
-				logUpstream("Content changed during retries. ETag or Last-Modified mismatch.")
-				conn, _, err := hj.Hijack()
-				if err != nil {
-					return err
-				}
-
-				// Close the hijacked raw tcp connection.
-				_ = conn.Close()
-
-				return fmt.Errorf("content changed during retries: ETag or Last-Modified mismatch")
+				logger.Error("Content changed during retries. ETag or Last-Modified mismatch.",
+					"etag", savedETag, "new_etag", currentETag, "last_modified", savedLastModified, "new_last_modified", currentLastModified)
+				return contentChanged(ctx, hj, fmt.Errorf("ETag %q, Last-Modified %q changed to ETag %q, Last-Modified %q",
+					savedETag, savedLastModified, currentETag, currentLastModified), "ETag or Last-Modified mismatch")
 			}
 		} else {
 			// Save ETag and Last-Modified headers on the first successful response
 			savedETag = currentETag
 			savedLastModified = currentLastModified
 		}
+		transferFrom(ctx).setETag(currentETag)
+
+		// Validate the size of the whole representation
+		if size := representationSize(resp); size >= 0 {
+			if savedSize >= 0 && size != savedSize {
+				logger.Error("Content changed during retries. Size mismatch.", "size", savedSize, "new_size", size)
+				return contentChanged(ctx, hj, fmt.Errorf("size %d changed to %d", savedSize, size), "size mismatch")
+			}
+			savedSize = size
+		}
 
 		// Validate Content-Range header
+		var dropped int64 // bytes of the body already sent to the client
 		contentRange := resp.Header.Get("Content-Range")
 		if rangesPossible && contentRange != "" {
 			var rangeStart, rangeEnd, totalSize int64
 			_, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &rangeStart, &rangeEnd, &totalSize)
 			if err != nil || rangeStart != bytesSent {
-				logUpstream("Invalid or mismatched Content-Range: %s. Expected start: %d", contentRange, bytesSent)
+				logger.Warn("Invalid or mismatched Content-Range", "content_range", contentRange, "expected_start", bytesSent)
 				// Consume the necessary bytes to align with the expected range
-				toConsume := bytesSent - rangeStart
-				if toConsume > 0 {
-					consumed := int64(0)
-					// Consume the bytes in chunks of 1MB
-					for consumed < toConsume {
-						nextChunk := min(toConsume-consumed, 32*1024*1024)
-						_, err := io.CopyN(io.Discard, resp.Body, nextChunk)
-						if err != nil {
-							logUpstream("Error consuming bytes to align with expected range: %v", err)
-							break
-						}
-						consumed += nextChunk
-						progress := 100 * consumed / toConsume // Correct progress calculation
-						logUpstream("Consumed %d bytes of %d to align with expected range. Progress: %d%%\n", consumed, toConsume, progress)
+				if toConsume := bytesSent - rangeStart; toConsume > 0 {
+					if dropped, err = discard(ctx, resp.Body, toConsume, buffer); err != nil {
+						logger.Warn("Error consuming bytes to align with expected range", "error", err)
 					}
 				}
 			}
 		} else if bytesSent > 0 {
 			// If Content-Range is missing or ranges are not possible, assume the response starts from the beginning
-			log.Printf("Content-Range header missing or ranges not supported. Consuming %d bytes to align.", bytesSent)
-			consumed := int64(0)
-			toConsume := bytesSent
-			// consume the bytes in chunks of 1MB
-			for consumed < toConsume {
-				nextChunk := min(toConsume-consumed, 32*1024*1024)
-				_, err := io.CopyN(io.Discard, resp.Body, nextChunk)
-				if err != nil {
-					logUpstream("Error consuming bytes to align with expected range: %v", err)
-					break
-				}
-				consumed += nextChunk
-				progress := 100 * consumed / toConsume // Correct progress calculation
-				logUpstream("Consumed %d bytes of %d to align with expected range. Progress: %d%%\n", consumed, toConsume, progress)
+			logger.Warn("Content-Range header missing or ranges not supported, consuming bytes to align", "bytes", bytesSent)
+			if dropped, err = discard(ctx, resp.Body, bytesSent, buffer); err != nil {
+				logger.Warn("Error consuming bytes to align with expected range", "error", err)
 			}
 		}
 
@@ -288,11 +451,10 @@ func resilientGet(r *http.Request, upstream string, hj http.Hijacker, w http.Res
 		if bytesSent == start || (bytesSent == 0 && start == -1) {
 			for key, values := range resp.Header {
 				for _, value := range values {
-					log.Printf("Header: %s: %s\n", key, value)
 					w.Header().Add(key, value)
 				}
 			}
-			if (start != 0 || end != 0) && !rangesPossible {
+			if r.Header.Get("Range") != "" && !rangesPossible {
 				if start == -1 {
 					start = 0
 				}
@@ -309,53 +471,103 @@ func resilientGet(r *http.Request, upstream string, hj http.Hijacker, w http.Res
 				w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
 				w.Header().Add("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, end+1))
 			}
-			log.Printf("Setting headers for the first response.\n")
-			// Print header line by line
-			for key, values := range w.Header() {
-				log.Printf("< %s: %s\n", key, values)
-			}
+			logger.Debug("Sending response headers", "status", resp.StatusCode)
+			logHeaders(ctx, logger, "Response header", w.Header())
 			w.WriteHeader(resp.StatusCode)
+			headersSent = true
+			wantEnd = announcedEnd(resp, bytesSent-dropped)
 		}
 
-		// Stream the response body to the client using a buffer
-		buffer := make([]byte, 1024*1024) // 1MB buffer
+		// Stream the response body to the client using the pooled buffer, or
+		// on the fast path with io.Copy
 		for {
-			n, readErr := resp.Body.Read(buffer)
-			if n > 0 {
-				attempt = max(0, attempt-1)
-				// Only write to the client if the block was read successfully
-				if _, writeErr := w.Write(buffer[:n]); writeErr != nil {
-					return fmt.Errorf("Error writing to client (attempt %d): %v\n", attempt, writeErr)
+			var readErr, writeErr error
+			if useFastPath(resp.Request.URL.Scheme, r.TLS != nil, limits) {
+				var n int64
+				n, readErr, writeErr = copyChunk(w, resp.Body, buffer)
+				if n > 0 {
+					attempt = max(0, attempt-1)
+					bytesSent += n // Exactly what the client connection took
+				}
+			} else {
+				var n int
+				n, readErr = resp.Body.Read(buffer)
+				if n > 0 {
+					attempt = max(0, attempt-1)
+					// A wait cut short fails like the read or write it paces;
+					// the bytes not sent are fetched again on the next attempt
+					if waitErr := limits.waitUpstream(upstreamCtx, n); waitErr != nil {
+						readErr = waitErr
+					} else if writeErr = limits.waitClient(ctx, n); writeErr == nil {
+						// Only write to the client if the block was read successfully
+						if _, writeErr = w.Write(buffer[:n]); writeErr == nil {
+							bytesSent += int64(n) // Track how many bytes have been sent
+						}
+					}
 				}
-				bytesSent += int64(n) // Track how many bytes have been sent
-				// log.Printf("Sent %d bytes to client. Total sent: %d bytes\n", n, bytesSent)
+			}
+			if writeErr != nil {
+				if ctx.Err() != nil {
+					return abandon(ctx, attempt)
+				}
+				transferFrom(ctx).setOutcome(outcomeAborted)
+				return fmt.Errorf("Error writing to client (attempt %d): %v\n", attempt, writeErr)
+			}
+			if readErr == io.EOF && bytesSent < wantEnd {
+				// A clean close short of the announced length is an interruption
+				shortResponses.Inc()
+				readErr = fmt.Errorf("upstream response ended after %d of %d bytes: %w", bytesSent, wantEnd, io.ErrUnexpectedEOF)
 			}
 			if readErr != nil {
 				if readErr == io.EOF {
 					// Successfully finished streaming
-					log.Printf("Finished streaming data to client.\n")
-					// log sent bytes
-					log.Printf("Total bytes sent: %d\n", bytesSent-start)
+					logger.Info("Finished streaming data to client", "bytes", bytesSent-max(start, 0))
+					transferFrom(ctx).setOutcome(outcomeComplete)
 					return nil
 				}
+				if ctx.Err() != nil {
+					return abandon(ctx, attempt)
+				}
+				if upstreamCtx.Err() != nil {
+					readErr = context.Cause(upstreamCtx)
+				}
 				lastUpstreamError = readErr
-				logUpstream("Error reading from upstream (attempt %d): %v\n", attempt, readErr)
+				transferFrom(ctx).setLastError(readErr)
+				transferFrom(ctx).publish(eventUpstreamError, func(e *transferEvent) {
+					e.Attempt = attempt
+					e.Error = readErr.Error()
+				})
+				logger.Warn("Error reading from upstream", "attempt", attempt, "bytes_sent", bytesSent, "error", readErr)
 				break
 			}
 		}
+		resp.Body.Close() // Free the upstream connection while waiting
 
 		// Retry if an error occurred
-		if attempt < maxRetries {
+		if attempt < policy.maxRetries {
 			attempt++
-			sleepTime := min(60, (attempt)*(attempt))
-			logUpstream("Retrying in %d seconds\n", sleepTime)
-			time.Sleep(retryDelay * time.Duration(sleepTime))
-			logUpstream("Retrying streaming... (%d/%d)\n", attempt, maxRetries)
+			delay := policy.backoff(attempt)
+			logger.Info("Retrying streaming", "attempt", attempt, "retries", policy.maxRetries, "delay", delay)
+			publishRetry(ctx, attempt, delay)
+			if err := sleepContext(upstreamCtx, delay); err != nil && ctx.Err() != nil {
+				return abandon(ctx, attempt)
+			}
 			continue
 		}
 	}
 
 	// If all retries fail, send the last upstream error to the client
+	retriesExhaustedTotal.Inc()
+	transferFrom(ctx).fail()
+	notifyTransfer(ctx, notifyRetriesExhausted, lastUpstreamError)
+	if headersSent {
+		// An error page would end up in the body; closing the connection
+		// tells the client the response is cut off.
+		if conn, _, err := hj.Hijack(); err == nil {
+			conn.Close()
+			return fmt.Errorf("response truncated after %d bytes: %v", bytesSent-max(start, 0), lastUpstreamError)
+		}
+	}
 	if lastUpstreamError != nil {
 		http.Error(w, fmt.Sprintf("Bad Gateway: %v", lastUpstreamError), http.StatusBadGateway)
 	} else {
@@ -363,3 +575,72 @@ func resilientGet(r *http.Request, upstream string, hj http.Hijacker, w http.Res
 	}
 	return nil
 }
+
+// contentChanged aborts a transfer whose content changed upstream while it
+// was resumed, closing the client connection so the client can tell.
+func contentChanged(ctx context.Context, hj http.Hijacker, change error, reason string) error {
+	contentChangedTotal.Inc()
+	transferFrom(ctx).setOutcome(outcomeContentChanged)
+	notifyTransfer(ctx, notifyContentChanged, change)
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+
+	// Close the hijacked raw tcp connection.
+	_ = conn.Close()
+
+	return fmt.Errorf("content changed during retries: %s", reason)
+}
+
+// representationSize returns the size of the whole content resp is all or
+// part of, or -1 if unknown.
+func representationSize(resp *http.Response) int64 {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength
+	case http.StatusPartialContent:
+		var first, last, size int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &size); err == nil {
+			return size
+		}
+	}
+	return -1
+}
+
+// announcedEnd returns where the body of resp announces to end, counting its
+// first byte as offset, or -1 if unknown. The offset is in the terms of
+// bytesSent, which for a suffix range counts from the start of the range
+// rather than of the whole content.
+func announcedEnd(resp *http.Response, offset int64) int64 {
+	length := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		length = resp.ContentLength
+	case http.StatusPartialContent:
+		var first, last int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/", &first, &last); err == nil {
+			length = last - first + 1
+		}
+	}
+	if length < 0 {
+		return -1
+	}
+	return offset + length
+}
+
+// retryable reports whether retrying may help after the upstream request
+// error err. A refused destination, redirect or certificate stays refused.
+func retryable(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	return !errors.Is(err, errPrivateAddress) && !errors.Is(err, errRedirectRefused) && !errors.As(err, &certErr)
+}
+
+// publishRetry announces that the transfer of ctx waits delay before its next
+// upstream request.
+func publishRetry(ctx context.Context, attempt int, delay time.Duration) {
+	transferFrom(ctx).publish(eventRetryScheduled, func(e *transferEvent) {
+		e.Attempt = attempt
+		e.Delay = delay
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAnnouncedLengths(t *testing.T) {
+	tests := []struct {
+		status        int
+		contentLength int64
+		contentRange  string
+		offset        int64
+		size, end     int64
+	}{
+		{http.StatusOK, 1000, "", 0, 1000, 1000},
+		{http.StatusOK, -1, "", 0, -1, -1},
+		{http.StatusPartialContent, 100, "bytes 500-599/1000", 500, 1000, 600},
+		{http.StatusPartialContent, 100, "bytes 500-599/*", 500, -1, 600},
+		{http.StatusPartialContent, 100, "bytes 900-999/1000", 0, 1000, 100}, // bytes=-100
+		{http.StatusPartialContent, -1, "bytes 500-599/1000", 500, 1000, 600},
+		{http.StatusNotFound, 9, "", 0, -1, -1},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, ContentLength: tt.contentLength, Header: http.Header{}}
+		if tt.contentRange != "" {
+			resp.Header.Set("Content-Range", tt.contentRange)
+		}
+		if got := representationSize(resp); got != tt.size {
+			t.Errorf("representationSize(%d %q) = %d, want %d", tt.status, tt.contentRange, got, tt.size)
+		}
+		if got := announcedEnd(resp, tt.offset); got != tt.end {
+			t.Errorf("announcedEnd(%d %q, %d) = %d, want %d", tt.status, tt.contentRange, tt.offset, got, tt.end)
+		}
+	}
+}
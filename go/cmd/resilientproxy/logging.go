@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// requestIDHeader carries the ID of a client request. An ID sent by the
+// client is kept, otherwise a new one is assigned; either way it is echoed
+// in the response.
+const requestIDHeader = "X-Request-ID"
+
+// logLevel is the minimum level logged; it can be changed at runtime through
+// the admin listener.
+var logLevel = new(slog.LevelVar)
+
+// redactedHeaders are never logged in clear text.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// setupLogging installs the default logger writing text or JSON to w.
+func setupLogging(w io.Writer, format, level string) error {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, opts)))
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// fatal logs msg as an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+type loggerKey struct{}
+
+// withRequestID returns a context carrying the request ID and a logger that
+// adds it to every line.
+func withRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return context.WithValue(ctx, loggerKey{}, slog.Default().With("request_id", id))
+}
+
+// requestIDFrom returns the request ID of a context, or "" if it has none.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// loggerFrom returns the logger of a request context, or the default logger.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// newRequestID returns a random ID for correlating the log lines of a
+// transfer.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID sent by the client if it looks sane, or a new one.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" || len(id) > 64 || strings.ContainsFunc(id, func(c rune) bool { return c <= ' ' || c > '~' }) {
+		return newRequestID()
+	}
+	return id
+}
+
+// logHeaders logs each header at debug level with credentials redacted.
+func logHeaders(ctx context.Context, logger *slog.Logger, msg string, header http.Header) {
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	for key, values := range header {
+		if redactedHeaders[http.CanonicalHeaderKey(key)] {
+			values = []string{"[REDACTED]"}
+		}
+		logger.DebugContext(ctx, msg, "header", key, "value", strings.Join(values, ", "))
+	}
+}
+
+// logLevelHandler reports the current log level on GET and changes it on
+// PUT or POST with a level name such as "debug" as the body.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := logLevel.UnmarshalText([]byte(strings.TrimSpace(string(body)))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("Log level changed", "level", logLevel.Level())
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintln(w, logLevel.Level())
+}
@@ -1,11 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Configuration
@@ -15,40 +29,469 @@ const (
 	TRUE_OR_SIMULATED_FALSE = true
 )
 
+// Exit codes
+const (
+	exitDrained          = 0 // All transfers finished before shutdown
+	exitTransfersAborted = 2 // The drain timeout cut off active transfers
+)
+
+// proxy serves client requests from the upstreams of their routes.
+type proxy struct {
+	routes    routeTable
+	accessLog *accessLog
+	forward   *forwardPolicy // nil unless forward-proxy requests are served
+	auth      *authenticator // nil unless clients must authenticate
+
+	retryAfter time.Duration // suggested to clients refused for lack of a free slot
+}
+
 // Proxy handler with Accept-Ranges validation
-func proxyHandler(w http.ResponseWriter, r *http.Request, upstream string) {
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Connection hijacking not supported", http.StatusInternalServerError)
 		return
 	}
 
-	if r.Method == http.MethodGet {
-		err := resilientGet(r, upstream, hj, w)
+	id := requestID(r)
+	rt := p.routes.match(r)
+	forward := p.forward != nil && (r.URL.IsAbs() || r.Method == http.MethodConnect)
+	if forward {
+		rt = p.forward.route(r)
+	}
+	identity, authenticated := identityFrom(r.Context())
+	var authErr error
+	if !authenticated {
+		identity, authErr = p.auth.authenticate(r, forward)
+	}
+	if authErr == nil {
+		authErr = p.auth.authorize(rt, identity)
+	}
+	route := "none"
+	if rt != nil {
+		route = rt.name
+	}
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "proxy "+r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", r.Method),
+		attribute.String("url.path", r.URL.Path),
+		attribute.String("http.request.header.range", r.Header.Get("Range")),
+		attribute.String("client.address", r.RemoteAddr),
+		attribute.String("resilientproxy.request_id", id),
+		attribute.String("resilientproxy.route", route)))
+	t, ctx := activeTransfers.begin(withRoute(withIdentity(withRequestID(ctx, id), identity), rt), id, r.RemoteAddr, r.URL.Path, route)
+	defer activeTransfers.end(t)
+	r = r.WithContext(ctx)
+	w.Header().Set(requestIDHeader, id)
+	w = &countingWriter{w, t}
+
+	logger := loggerFrom(r.Context())
+	logger.Info("Client request", "method", r.Method, "path", r.URL.Path, "client", r.RemoteAddr, "range", r.Header.Get("Range"))
+	logHeaders(r.Context(), logger, "Client request header", r.Header)
+
+	// Only GET requests transfer anything; tunnels hold no slot, but the
+	// requests intercepted in them do.
+	var admitErr error
+	if authErr == nil && rt != nil && r.Method == http.MethodGet {
+		queued := time.Now()
+		if admitErr = requestSlots.acquire(r.Context(), t.clientKey()); admitErr == nil {
+			defer requestSlots.release()
+			if waited := time.Since(queued); waited > time.Millisecond {
+				logger.Debug("Client request waited for a free slot", "waited", waited.Round(time.Millisecond))
+			}
+		}
+	}
+
+	var err error
+	if authErr != nil {
+		logger.Warn("Client request refused", "host", r.Host, "path", r.URL.Path, "error", authErr)
+		p.auth.deny(w, authErr, forward)
+		if errors.Is(authErr, errForbidden) {
+			authFailures.WithLabelValues("forbidden").Inc()
+		} else {
+			authFailures.WithLabelValues("unauthenticated").Inc()
+		}
+		t.setOutcome(outcomeFailed)
+	} else if rt == nil {
+		logger.Warn("No route matches the request", "host", r.Host, "path", r.URL.Path)
+		http.Error(w, "Not Found: no route matches the request", http.StatusNotFound)
+		t.setOutcome(outcomeFailed)
+	} else if admitErr != nil {
+		if r.Context().Err() != nil {
+			err = abandon(r.Context(), 0)
+		} else {
+			logger.Warn("Client request refused, no free slot", "error", admitErr)
+			refuse(w, admitErr, p.retryAfter)
+			t.setOutcome(outcomeFailed)
+		}
+	} else if forward && r.Method == http.MethodConnect {
+		if err = p.forward.tunnel(r, hj, w, p); err != nil {
+			logger.Error("Error in tunnel", "error", err)
+		}
+	} else if forward && r.Method == http.MethodGet {
+		if err = p.forward.serve(r, rt, hj, w); err != nil {
+			logger.Error("Error in proxyHandler", "error", err)
+		}
+	} else if r.Method == http.MethodGet {
+		upstreamReq := r
+		if path := rt.rewrite(r.URL.Path); path != r.URL.Path {
+			upstreamReq = r.Clone(r.Context())
+			upstreamReq.URL.Path, upstreamReq.URL.RawPath = path, ""
+			logger.Debug("Rewrote path", "path", path)
+		}
+		rw := &headerRuleWriter{ResponseWriter: w, rules: &rt.responseHeaders}
+		if rt.downloads != nil {
+			err = rt.downloads.serve(upstreamReq, hj, rw)
+		} else {
+			err = resilientGet(upstreamReq, rt.upstreams[0], hj, rw)
+		}
 		if err != nil {
-			log.Printf("Error in proxyHandler: %v\n", err)
+			logger.Error("Error in proxyHandler", "error", err)
 		}
 	} else {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		t.setOutcome(outcomeFailed)
+	}
+	if errors.Is(context.Cause(r.Context()), errCancelled) && t.status.Load() != 0 {
+		// Close the connection so the client can tell the response is cut off.
+		if conn, _, err := hj.Hijack(); err == nil {
+			conn.Close()
+		}
 	}
+	t.observe()
+	t.publishEnd(err)
+	notifier.transferEnded(t, err)
+	p.accessLog.log(r, t, err)
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", int(t.status.Load())),
+		attribute.Int64("http.response.body.size", t.bytesSent.Load()),
+		attribute.Int64("resilientproxy.upstream_attempts", t.attempts.Load()),
+		attribute.Int64("resilientproxy.resumes", t.resumes.Load()),
+		attribute.Int64("resilientproxy.bytes_discarded", t.discarded.Load()),
+		attribute.Int64("resilientproxy.backoff_waited_ms", time.Duration(t.backoff.Load()).Milliseconds()),
+		attribute.String("resilientproxy.outcome", t.getOutcome(err)))
+	endSpan(span, err)
 }
 
 func main() {
 	// Parse CLI arguments for port and upstream URL
 	port := flag.Int("port", 3000, "Port to run the proxy server on")
-	upstream := flag.String("upstream", "", "Upstream server URL")
+	upstream := flag.String("upstream", "", "Upstream server URL of the default route, which matches requests no other route does")
+	routesFile := flag.String("routes", "", "JSON file with routes to upstreams by host, path prefix or path regex")
+	adminPort := flag.Int("adminPort", 0, "Port for the admin listener (default: 0, disabled)")
+	adminToken := flag.String("adminToken", "", "Bearer token required on the admin listener (default: $"+adminTokenEnv+"); the transfers API and changing the log level or bandwidth limits are disabled without one")
+	detached := flag.String("detached", "", "Comma-separated path prefixes whose downloads continue in the background after the client disconnects")
+	cacheDir := flag.String("cacheDir", filepath.Join(os.TempDir(), "resilientproxy"), "Directory for background downloads")
+	detachedTTL := flag.Duration("detachedTTL", 10*time.Minute, "How long a completed background download is kept for later requests")
+	drainTimeout := flag.Duration("drainTimeout", time.Minute, "How long active transfers may run after SIGINT/SIGTERM before they are aborted")
+	pidFile := flag.String("pidFile", "", "File to write the process ID to, e.g. for sending SIGUSR2")
+	logFormat := flag.String("logFormat", "text", "Log format: text or json")
+	level := flag.String("logLevel", "info", "Minimum log level: debug, info, warn or error")
+	accessLogPath := flag.String("accessLog", "", "File to write the access log to, - for stdout (default: disabled)")
+	accessLogFormat := flag.String("accessLogFormat", "combined", "Access log format: common, combined, proxy, json or a Go template")
+	var webhooks stringList
+	flag.Var(&webhooks, "webhook", "URL to POST notifications to, optionally limited to some events as EVENT,EVENT=URL; repeatable")
+	webhookRetries := flag.Int("webhookRetries", 5, "Delivery attempts after the first before a notification goes to the dead-letter file")
+	webhookResumes := flag.Int64("webhookResumes", 3, "Resumes after which a completed transfer is reported as recovered")
+	webhookDeadLetter := flag.String("webhookDeadLetter", "", "File for undeliverable notifications (default: webhooks-deadletter.ndjson in -cacheDir)")
+	readyCheck := flag.String("readyCheck", readyCircuit, "What /readyz checks: circuit (no upstream circuit open), probe (HEAD request to each upstream) or none")
+	readyTimeout := flag.Duration("readyTimeout", 2*time.Second, "Timeout of a readiness probe")
+	circuitThreshold := flag.Int("circuitThreshold", 5, "Consecutive failed upstream requests after which the upstream's circuit opens")
+	forward := flag.Bool("forward", false, "Also serve forward-proxy requests (absolute-form request URIs and CONNECT)")
+	forwardAllow := flag.String("forwardAllow", "", "Comma-separated destination hosts forward-proxy requests may reach, e.g. example.com,*.example.org (default: all)")
+	forwardDeny := flag.String("forwardDeny", "", "Comma-separated destination hosts forward-proxy requests may not reach")
+	forwardConnectPorts := flag.String("forwardConnectPorts", "443", "Comma-separated ports CONNECT tunnels may reach")
+	forwardAllowPrivate := flag.Bool("forwardAllowPrivate", false, "Let forward-proxy requests reach loopback, private and link-local addresses")
+	tlsCert := flag.String("tlsCert", "", "PEM certificate to serve HTTPS with instead of HTTP")
+	tlsKey := flag.String("tlsKey", "", "PEM private key of -tlsCert")
+	clientCA := flag.String("clientCA", "", "PEM CA certificates for client certificates; clients presenting one are identified by its subject (needs -tlsCert)")
+	clientSubject := flag.String("clientSubject", "", "Regular expression client certificate subjects such as CN=ci,O=Example must match")
+	authTokens := flag.String("authTokens", "", "File with an identity:token line per client allowed to authenticate with a bearer token")
+	htpasswd := flag.String("htpasswd", "", "htpasswd file (bcrypt or {SHA}) for clients authenticating with HTTP Basic")
+	resignCommand := flag.String("resignCommand", "", "Command printing a fresh URL for the expired pre-signed upstream URL given as its last argument, run when a resume gets 403")
+	resignURL := flag.String("resignURL", "", `URL POSTed {"url": expired} when a resume gets 403, answering {"url": fresh}`)
+	egress := flag.String("egressProxy", "", "Proxy for requests to configured upstreams (not forward-proxy destinations): direct, or an http://, https:// or socks5:// URL with optional user:pass@ (default: from HTTP_PROXY, HTTPS_PROXY and NO_PROXY); routes may override it")
+	upstreamCA := flag.String("upstreamCA", "", "PEM file with CA certificates trusted besides those of the system when verifying forward-proxy destinations and upstreams of routes with credentials")
+	mitmCA := flag.String("mitmCA", "", "PEM file with the CA certificate that signs the certificates of intercepted hosts")
+	mitmKey := flag.String("mitmKey", "", "PEM file with the private key of -mitmCA")
+	mitmHosts := flag.String("mitmHosts", "", "Comma-separated hosts whose CONNECT tunnels are intercepted with -mitmCA, so their downloads can be resumed")
+	bandwidthLimit := flag.Int64("bandwidth", 0, "Bytes per second all clients together may receive (default: 0, unlimited); changeable at /bandwidth on the admin listener")
+	clientBandwidth := flag.Int64("clientBandwidth", 0, "Bytes per second each client identity, or address if anonymous, may receive (default: 0, unlimited)")
+	upstreamBandwidth := flag.Int64("upstreamBandwidth", 0, "Bytes per second the proxy may read from upstreams together (default: 0, unlimited)")
+	maxRequests := flag.Int("maxRequests", 0, "Client requests served at once; more wait in a queue served round-robin by client (default: 0, unlimited)")
+	maxQueue := flag.Int("maxQueue", 100, "Client requests that may wait for a free slot; more are refused with 503")
+	queueTimeout := flag.Duration("queueTimeout", 30*time.Second, "How long a client request may wait for a free slot before it is refused with 503")
+	retryAfter := flag.Duration("retryAfter", 5*time.Second, "Retry-After sent with 503 responses to requests that got no free slot")
+	maxUpstreamConns := flag.Int("maxUpstreamConns", 0, "Connections to each upstream host at once; more requests wait, served round-robin by client (default: 0, unlimited)")
+	bufferSize := flag.Int("bufferSize", defaultBufferSize, "Bytes of the buffer each transfer copies the upstream response through")
+	memoryBudget := flag.Int64("memoryBudget", 0, "Bytes all transfer buffers together may take; further transfers wait for a buffer (default: 0, unlimited)")
+	fastPathFlag := flag.Bool("fastPath", false, "Copy plain-HTTP responses without bandwidth limits with io.Copy instead of the transfer buffer, letting the runtime choose how")
+	otlpEndpoint := flag.String("otlpEndpoint", "", "OTLP/HTTP endpoint to export traces to, e.g. http://localhost:4318/v1/traces (default: from OTEL_EXPORTER_OTLP_ENDPOINT, or disabled)")
 	flag.Parse()
 
+	if err := setupLogging(os.Stderr, *logFormat, *level); err != nil {
+		fatal("Invalid logging configuration", "error", err)
+	}
+
+	shutdownTracing, err := setupTracing(context.Background(), *otlpEndpoint)
+	if err != nil {
+		fatal("Unable to set up tracing", "error", err)
+	}
+
 	// Print startup information
-	log.Printf("Starting retry proxy server...\n")
-	log.Printf("Upstream server: %s\n", *upstream)
-	log.Printf("Listening on port: %d\n", *port)
+	slog.Info("Starting retry proxy server", "upstream", *upstream, "port", *port)
+
+	// Every request context derives from baseCtx, so cancelling it on a
+	// signal stops all upstream fetches and backoff sleeps.
+	baseCtx, cancel := context.WithCancelCause(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	upgrades := make(chan os.Signal, 1)
+	signal.Notify(upgrades, syscall.SIGUSR2)
+
+	upstreamProxy, err := egressProxy(*egress, nil)
+	if err != nil {
+		fatal("Invalid egress proxy", "error", err)
+	}
+	if *egress != "" {
+		slog.Info("Egress proxy", "proxy", redactProxy(*egress))
+	}
+	resigner, err := newResigner(*resignCommand, *resignURL, 0)
+	if err != nil {
+		fatal("Invalid re-signing configuration", "error", err)
+	}
+	var routes []*route
+	if *routesFile != "" {
+		routes, err = loadRoutes(baseCtx, *routesFile, *cacheDir, *detachedTTL, *egress, resigner)
+		if err != nil {
+			fatal("Unable to load routes", "error", err)
+		}
+	}
+	if *upstream != "" {
+		if *detached != "" {
+			prefixes := strings.Split(*detached, ",")
+			slog.Info("Detached downloads enabled", "prefixes", prefixes, "cache", *cacheDir)
+			downloads, err := newDownloadManager(baseCtx, *upstream, *cacheDir, *detachedTTL)
+			if err != nil {
+				fatal("Unable to set up detached downloads", "error", err)
+			}
+			for _, prefix := range prefixes {
+				routes = append(routes, &route{name: "detached", pathPrefix: prefix, upstreams: []string{*upstream},
+					retry: defaultRetryPolicy, downloads: downloads, proxy: upstreamProxy, resigner: resigner, index: len(routes)})
+			}
+		}
+		routes = append(routes, &route{name: "default", upstreams: []string{*upstream}, retry: defaultRetryPolicy, proxy: upstreamProxy, resigner: resigner, index: len(routes)})
+	}
+	if len(routes) == 0 && !*forward {
+		fatal("No upstream configured, use -upstream, -routes or -forward")
+	}
+	if *clientCA != "" && *tlsCert == "" {
+		fatal("-clientCA needs -tlsCert")
+	}
+	auth, err := newAuthenticator(*authTokens, *htpasswd, *clientCA, *clientSubject)
+	if err != nil {
+		fatal("Invalid client authentication configuration", "error", err)
+	}
+	if *upstreamCA != "" {
+		if upstreamRoots, err = loadUpstreamRoots(*upstreamCA); err != nil {
+			fatal("Invalid upstream CA", "error", err)
+		}
+	}
+	p := &proxy{routes: newRouteTable(routes), auth: auth, retryAfter: *retryAfter}
+	if *forward {
+		p.forward = newForwardPolicy(*forwardAllow, *forwardDeny, *forwardConnectPorts, *forwardAllowPrivate)
+		slog.Info("Forward proxy enabled", "allow", p.forward.allow, "deny", p.forward.deny, "connect_ports", p.forward.connectPorts, "allow_private", *forwardAllowPrivate)
+		if *mitmCA != "" {
+			if p.forward.mitm, err = newInterceptor(*mitmCA, *mitmKey, *mitmHosts); err != nil {
+				fatal("Unable to set up HTTPS interception", "error", err)
+			}
+			slog.Info("HTTPS interception enabled", "hosts", p.forward.mitm.hosts, "ca", p.forward.mitm.ca.Subject.String())
+		}
+	}
+	for _, rt := range p.routes {
+		slog.Info("Route", "name", rt.name, "host", rt.host, "path_prefix", rt.pathPrefix, "path_regex", rt.pathRegex, "upstreams", rt.upstreams, "allow", rt.allow)
+	}
+	limits := bandwidthLimits{Global: *bandwidthLimit, PerClient: *clientBandwidth, Upstream: *upstreamBandwidth, Routes: map[string]int64{}}
+	for _, rt := range p.routes {
+		if rt.bandwidth > 0 {
+			limits.Routes[rt.name] = rt.bandwidth
+		}
+	}
+	if err := bandwidth.set(limits); err != nil {
+		fatal("Invalid bandwidth limits", "error", err)
+	}
+	if *maxRequests < 0 || *maxQueue < 0 || *maxUpstreamConns < 0 {
+		fatal("-maxRequests, -maxQueue and -maxUpstreamConns must not be negative")
+	}
+	requestSlots.limit, requestSlots.maxWaiting, requestSlots.timeout = *maxRequests, *maxQueue, *queueTimeout
+	upstreamSlots.limit = *maxUpstreamConns
+	if *maxRequests > 0 || *maxUpstreamConns > 0 {
+		slog.Info("Concurrency limits", "max_requests", *maxRequests, "max_queue", *maxQueue, "queue_timeout", *queueTimeout,
+			"max_upstream_conns", *maxUpstreamConns)
+	}
+	if *bufferSize < 4096 {
+		fatal("-bufferSize must be at least 4096")
+	}
+	if *memoryBudget != 0 && *memoryBudget < int64(*bufferSize) {
+		fatal("-memoryBudget must hold at least one buffer of -bufferSize")
+	}
+	buffers = newBufferPool(*bufferSize, *memoryBudget)
+	fastPath = *fastPathFlag
+	if *memoryBudget > 0 {
+		slog.Info("Memory budget", "bytes", *memoryBudget, "buffer_size", *bufferSize, "buffers", buffers.budget.limit)
+	}
+	upstreamCircuits.threshold = *circuitThreshold
+	if len(webhooks) > 0 {
+		if *webhookDeadLetter == "" {
+			*webhookDeadLetter = filepath.Join(*cacheDir, "webhooks-deadletter.ndjson")
+		}
+		var err error
+		notifier, err = newWebhookNotifier(webhooks, *webhookDeadLetter, *webhookRetries, *webhookResumes)
+		if err != nil {
+			fatal("Unable to set up webhooks", "error", err)
+		}
+	}
+	if *accessLogPath != "" {
+		var err error
+		p.accessLog, err = newAccessLog(*accessLogPath, *accessLogFormat)
+		if err != nil {
+			fatal("Unable to set up the access log", "error", err)
+		}
+	}
+
+	server := &http.Server{
+		Handler: p, // Not a ServeMux, which answers CONNECT requests with 404
+
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	ln, err := listen("proxy", fmt.Sprintf(":%d", *port))
+	if err != nil {
+		fatal("Unable to listen", "port", *port, "error", err)
+	}
+	if *tlsCert != "" {
+		config, err := tlsConfig(*tlsCert, *tlsKey, *clientCA)
+		if err != nil {
+			fatal("Invalid TLS configuration", "error", err)
+		}
+		ln = tls.NewListener(ln, config)
+	}
+
+	var adminServer *http.Server
+	if *adminPort != 0 {
+		if *adminToken == "" {
+			*adminToken = os.Getenv(adminTokenEnv)
+		}
+		if *adminToken == "" {
+			slog.Warn("No admin token set, the admin listener is unauthenticated and the transfers API is disabled")
+		}
+		ready, err := newReadiness(p.routes.upstreams(), p.routes.transport, *readyCheck, *readyTimeout)
+		if err != nil {
+			fatal("Invalid readiness configuration", "error", err)
+		}
+		adminServer = &http.Server{Handler: newAdminHandler(*adminToken, ready)}
+		adminLn, err := listen("admin", fmt.Sprintf(":%d", *adminPort))
+		if err != nil {
+			fatal("Unable to listen", "port", *adminPort, "error", err)
+		}
+		go func() {
+			slog.Info("Admin listener is running", "url", fmt.Sprintf("http://localhost:%d", *adminPort))
+			if err := adminServer.Serve(adminLn); err != http.ErrServerClosed {
+				fatal("Admin listener failed", "error", err)
+			}
+		}()
+	}
+
+	exitCode := make(chan int, 1)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				slog.Info("Received signal, draining active transfers", "signal", sig, "timeout", *drainTimeout)
+			case <-upgrades:
+				slog.Info("Received SIGUSR2, handing over the listening sockets")
+				if err := restart(); err != nil {
+					slog.Error("Restart failed, continuing to serve", "error", err)
+					continue
+				}
+				slog.Info("New process is ready, draining active transfers", "timeout", *drainTimeout)
+			}
+			exitCode <- drain(server, adminServer, signals, *drainTimeout, cancel)
+			return
+		}
+	}()
+
+	if *pidFile != "" {
+		if err := os.WriteFile(*pidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+			fatal("Unable to write pid file", "error", err)
+		}
+	}
+	notifyReady()
+
+	slog.Info("Retry proxy server is running", "url", fmt.Sprintf("http://localhost:%d", *port))
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		fatal("Proxy listener failed", "error", err)
+	}
+	code := <-exitCode
+	flushCtx, stopFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stopFlush()
+	notifier.shutdown(flushCtx)
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("Unable to flush traces", "error", err)
+	}
+	os.Exit(code)
+}
+
+// stringList collects the values of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
-	// Set the upstream URL globally
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		proxyHandler(w, r, *upstream)
-	})
+// drain stops accepting connections and waits for active transfers to finish.
+// Transfers still running when the timeout expires or another signal arrives
+// are reported and aborted. It returns the process exit code.
+func drain(server, adminServer *http.Server, signals <-chan os.Signal, timeout time.Duration, cancel context.CancelCauseFunc) int {
+	ctx, stop := context.WithTimeout(context.Background(), timeout)
+	defer stop()
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Warn("Received signal again, aborting active transfers", "signal", sig)
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+
+	if adminServer != nil {
+		go adminServer.Shutdown(ctx)
+	}
+	err := server.Shutdown(ctx)
+	if err == nil {
+		// Background downloads are not tied to a connection.
+		err = activeTransfers.wait(ctx)
+	}
+	if err == nil {
+		slog.Info("All transfers finished, exiting")
+		return exitDrained
+	}
 
-	log.Printf("Retry proxy server is running on http://localhost:%d\n", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+	remaining := activeTransfers.snapshot()
+	slog.Warn("Drain timeout reached, aborting active transfers", "count", len(remaining))
+	for _, t := range remaining {
+		slog.Warn("Aborting transfer", "request_id", t.requestID, "client", t.client, "path", t.path,
+			"bytes_sent", t.bytesSent.Load(), "duration", time.Since(t.started).Round(time.Millisecond))
+	}
+	cancel(errShutdown)
+	server.Close()
+	// Give the aborted handlers a moment to record why they stopped.
+	wait, stopWait := context.WithTimeout(context.Background(), time.Second)
+	defer stopWait()
+	activeTransfers.wait(wait)
+	return exitTransfersAborted
 }
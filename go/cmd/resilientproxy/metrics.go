@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// errShutdown is the cancellation cause of the server's base context.
+var errShutdown = errors.New("server shutting down")
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "requests_total",
+		Help:      "Client requests by route and response status code.",
+	}, []string{"route", "code"})
+
+	upstreamAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "upstream_attempts_total",
+		Help:      "Upstream requests by outcome (success, error_status, retry).",
+	}, []string{"outcome"})
+
+	authenticatedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "authenticated_requests_total",
+		Help:      "Client requests by authenticated identity and route.",
+	}, []string{"identity", "route"})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "auth_failures_total",
+		Help:      "Client requests refused by reason (unauthenticated, forbidden).",
+	}, []string{"reason"})
+
+	resumesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "resumes_total",
+		Help:      "Transfers continued after an interruption, by method (range or full re-download).",
+	}, []string{"method"})
+
+	resignedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "resigned_urls_total",
+		Help:      "Expired pre-signed upstream URLs renewed by the re-signing hook.",
+	})
+
+	bandwidthWaited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "bandwidth_wait_seconds_total",
+		Help:      "Time transfers waited for bandwidth by direction (client, upstream).",
+	}, []string{"direction"})
+
+	alignmentDiscardedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "alignment_discarded_bytes_total",
+		Help:      "Bytes re-downloaded and discarded to align a resumed response with what was already sent.",
+	})
+
+	contentChangedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "content_changed_total",
+		Help:      "Transfers aborted because the upstream ETag, Last-Modified or size changed.",
+	})
+
+	shortResponses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "short_upstream_responses_total",
+		Help:      "Upstream responses that ended cleanly before their announced length and were resumed.",
+	})
+
+	retriesExhaustedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "retries_exhausted_total",
+		Help:      "Transfers given up after all retries failed.",
+	})
+
+	abandonedTransfers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "abandoned_transfers_total",
+		Help:      "Transfers given up because their request context ended, by reason (client_gone, shutdown, cancelled).",
+	}, []string{"reason"})
+
+	detachedDownloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "resilientproxy",
+		Name:      "detached_downloads_total",
+		Help:      "Background download events (started, joined, completed, failed).",
+	}, []string{"event"})
+
+	timeToFirstByte = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "resilientproxy",
+		Name:      "time_to_first_byte_seconds",
+		Help:      "Time from receiving a client request to sending the first body byte.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"route"})
+
+	transferDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "resilientproxy",
+		Name:      "transfer_duration_seconds",
+		Help:      "Time from receiving a client request to finishing its response.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16),
+	}, []string{"route"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		authenticatedRequests,
+		authFailures,
+		upstreamAttempts,
+		resumesTotal,
+		resignedTotal,
+		bandwidthWaited,
+		alignmentDiscardedBytes,
+		contentChangedTotal,
+		shortResponses,
+		retriesExhaustedTotal,
+		abandonedTransfers,
+		detachedDownloads,
+		timeToFirstByte,
+		transferDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "resilientproxy",
+			Name:      "active_transfers",
+			Help:      "Client requests and background downloads in progress.",
+		}, func() float64 { return float64(len(activeTransfers.snapshot())) }),
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// abandon records that a transfer was given up because ctx is done and
+// returns the error describing why.
+func abandon(ctx context.Context, attempt int) error {
+	reason := "client_gone"
+	if errors.Is(context.Cause(ctx), errShutdown) {
+		reason = "shutdown"
+	} else if errors.Is(context.Cause(ctx), errCancelled) {
+		reason = "cancelled"
+	}
+	abandonedTransfers.WithLabelValues(reason).Inc()
+	transferFrom(ctx).setOutcome(outcomeAborted)
+	return fmt.Errorf("transfer abandoned (%s) at attempt %d: %w", reason, attempt, context.Cause(ctx))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leafValidity is how long a minted certificate is valid. It is renewed when
+// less than half of that is left.
+const leafValidity = 24 * time.Hour
+
+// http1Only are the protocols offered by the TLS listeners of the proxy.
+// Resuming needs a hijackable HTTP/1 connection, so HTTP/2 is not offered.
+var http1Only = []string{"http/1.1"}
+
+// interceptor terminates the TLS of CONNECT tunnels to configured hosts with
+// certificates minted from a local CA, so the requests inside are proxied
+// and resumed like any other.
+type interceptor struct {
+	ca    *x509.Certificate
+	caKey any
+	hosts []string // host patterns to intercept
+	key   *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// newInterceptor loads the CA from PEM files. hosts is a comma-separated
+// list of host patterns such as "example.com,*.example.org".
+func newInterceptor(certFile, keyFile, hosts string) (*interceptor, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load CA: %v", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse CA certificate: %v", err)
+	}
+	if !ca.IsCA {
+		return nil, fmt.Errorf("certificate %s is not a CA", certFile)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	in := &interceptor{ca: ca, caKey: pair.PrivateKey, key: key, certs: make(map[string]*tls.Certificate)}
+	for _, pattern := range strings.Split(hosts, ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			in.hosts = append(in.hosts, pattern)
+		}
+	}
+	if len(in.hosts) == 0 {
+		return nil, fmt.Errorf("no hosts to intercept")
+	}
+	return in, nil
+}
+
+// intercepts reports whether tunnels to host are intercepted; in may be nil.
+func (in *interceptor) intercepts(host string) bool {
+	if in == nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range in.hosts {
+		if hostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// certificate returns a certificate for host signed by the CA, minting one
+// if there is none or it is about to expire.
+func (in *interceptor) certificate(host string) (*tls.Certificate, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if cert, ok := in.certs[host]; ok && time.Until(cert.Leaf.NotAfter) > leafValidity/2 {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(leafValidity)
+	if notAfter.After(in.ca.NotAfter) {
+		notAfter = in.ca.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour), // Tolerate clients with a clock that is behind
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, in.ca, &in.key.PublicKey, in.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to mint certificate for %s: %v", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, in.ca.Raw}, PrivateKey: in.key, Leaf: leaf}
+	in.certs[host] = cert
+	return cert, nil
+}
+
+// serve terminates TLS on conn, a tunnel the client opened to authority,
+// and passes the decrypted requests to handler as absolute-form requests
+// for https://authority. It returns when the client closes the connection
+// or ctx is done.
+func (in *interceptor) serve(ctx context.Context, conn net.Conn, authority string, handler http.Handler) {
+	host, _, _ := net.SplitHostPort(authority)
+	tlsConn := tls.Server(conn, &tls.Config{
+		NextProtos: http1Only,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return in.certificate(host)
+		},
+	})
+
+	ln := &connListener{conn: tlsConn, addr: conn.LocalAddr(), done: make(chan struct{})}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Requests go where the tunnel was opened to, whatever their Host says.
+			r.URL.Scheme, r.URL.Host, r.Host = "https", authority, authority
+			handler.ServeHTTP(w, r)
+		}),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				ln.Close()
+			}
+		},
+	}
+	stop := context.AfterFunc(ctx, func() { server.Close() })
+	defer stop()
+	server.Serve(ln)
+}
+
+// bufferedConn is a connection whose first bytes were already read into a
+// buffer.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// connListener is a listener accepting a single connection.
+type connListener struct {
+	conn net.Conn
+	addr net.Addr
+	once sync.Once
+	done chan struct{}
+}
+
+func (ln *connListener) Accept() (net.Conn, error) {
+	if conn := ln.conn; conn != nil {
+		ln.conn = nil
+		return conn, nil
+	}
+	<-ln.done
+	return nil, net.ErrClosed
+}
+
+func (ln *connListener) Close() error {
+	ln.once.Do(func() { close(ln.done) })
+	return nil
+}
+
+func (ln *connListener) Addr() net.Addr {
+	return ln.addr
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// resigner renews an expired pre-signed upstream URL, such as an S3 URL
+// whose signature expired during a long outage, by running a command or
+// calling an HTTP endpoint.
+type resigner struct {
+	command  []string // run with the expired URL as the last argument; prints the fresh URL
+	callback string   // POSTed {"url": expired, "request_id": ...}; answers {"url": fresh}
+	timeout  time.Duration
+}
+
+// resignConfig is the re-signing hook of a route in the -routes file.
+type resignConfig struct {
+	Command string   `json:"command"`
+	URL     string   `json:"url"`
+	Timeout duration `json:"timeout"`
+}
+
+// newResigner returns a resigner running command, split at spaces, or
+// calling callback; nil if both are empty.
+func newResigner(command, callback string, timeout time.Duration) (*resigner, error) {
+	switch {
+	case command == "" && callback == "":
+		return nil, nil
+	case command != "" && callback != "":
+		return nil, fmt.Errorf("re-signing needs either a command or a URL, not both")
+	case callback != "" && !strings.HasPrefix(callback, "http://") && !strings.HasPrefix(callback, "https://"):
+		return nil, fmt.Errorf("invalid re-signing URL %q", callback)
+	}
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &resigner{command: strings.Fields(command), callback: callback, timeout: timeout}, nil
+}
+
+// resign returns a fresh URL for the expired one, calling the callback with
+// client.
+func (rs *resigner) resign(ctx context.Context, client *http.Client, expired string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, rs.timeout)
+	defer cancel()
+	var fresh string
+	if len(rs.command) > 0 {
+		cmd := exec.CommandContext(ctx, rs.command[0], append(rs.command[1:], expired)...)
+		cmd.Env = append(os.Environ(), "RESILIENTPROXY_REQUEST_ID="+requestIDFrom(ctx))
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("re-signing command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		fresh = strings.TrimSpace(string(out))
+	} else {
+		body, _ := json.Marshal(map[string]string{"url": expired, "request_id": requestIDFrom(ctx)})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, rs.callback, bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("re-signing callback failed: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("re-signing callback returned status: %d", resp.StatusCode)
+		}
+		var answer struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&answer); err != nil {
+			return "", fmt.Errorf("invalid re-signing callback answer: %v", err)
+		}
+		fresh = answer.URL
+	}
+	if u, err := url.Parse(fresh); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("re-signing returned an invalid URL %q", fresh)
+	}
+	return fresh, nil
+}
+
+// resignUpstreamURL renews the expired pre-signed URL of the transfer of ctx
+// with the hook of its route, so its next upstream request goes to the fresh
+// URL. The callback goes out like the upstream requests of the route, through
+// its egress proxy.
+func resignUpstreamURL(ctx context.Context, expired string) error {
+	rt := routeFrom(ctx)
+	if rt == nil || rt.resigner == nil {
+		return fmt.Errorf("no re-signing hook configured")
+	}
+	t := transferFrom(ctx)
+	fresh, err := rt.resigner.resign(ctx, &http.Client{Transport: rt.transport()}, expired)
+	if err != nil {
+		return err
+	}
+	loggerFrom(ctx).Info("Re-signed upstream URL", "url", redactQuery(expired), "new_url", redactQuery(fresh))
+	resignedTotal.Inc()
+	t.setSignedURL(fresh)
+	return nil
+}
+
+// redactQuery returns rawURL without its query, which holds the signature
+// of a pre-signed URL.
+func redactQuery(rawURL string) string {
+	if i := strings.IndexByte(rawURL, '?'); i >= 0 {
+		return rawURL[:i] + "?[REDACTED]"
+	}
+	return rawURL
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A restarted process finds its listeners on the file descriptors after
+// stderr, named in the order given by envInheritedFDs. It reports that it is
+// serving by writing "ready" to the pipe whose descriptor is in envReadyFD.
+const (
+	envInheritedFDs = "RESILIENTPROXY_FDS"
+	envReadyFD      = "RESILIENTPROXY_READY_FD"
+	firstInheritFD  = 3
+	restartTimeout  = 30 * time.Second
+)
+
+type namedListener struct {
+	name string
+	net.Listener
+}
+
+var (
+	inheritOnce sync.Once
+	inherited   map[string]net.Listener
+	listeners   []namedListener
+)
+
+// listen returns the listener called name, taken over from a parent process
+// or systemd socket activation if one was passed in, or a new one on addr.
+func listen(name, addr string) (net.Listener, error) {
+	inheritOnce.Do(func() {
+		var err error
+		inherited, err = inheritListeners()
+		if err != nil {
+			slog.Warn("Ignoring inherited sockets", "error", err)
+		}
+	})
+
+	ln, ok := inherited[name]
+	if ok {
+		slog.Info("Using inherited socket", "name", name, "addr", ln.Addr())
+		delete(inherited, name)
+	} else {
+		var err error
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listeners = append(listeners, namedListener{name, ln})
+	return ln, nil
+}
+
+// inheritListeners collects the sockets passed in by a restarting parent or
+// by systemd (LISTEN_FDS). Sockets from systemd are named by LISTEN_FDNAMES,
+// falling back to "proxy" and "admin" in that order.
+func inheritListeners() (map[string]net.Listener, error) {
+	var names []string
+	if value := os.Getenv(envInheritedFDs); value != "" {
+		names = strings.Split(value, ",")
+	} else if os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid LISTEN_FDS: %v", err)
+		}
+		names = []string{"proxy", "admin"}
+		if value := os.Getenv("LISTEN_FDNAMES"); value != "" {
+			names = strings.Split(value, ":")
+		}
+		if len(names) > count {
+			names = names[:count]
+		}
+	}
+	for _, key := range []string{envInheritedFDs, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(key)
+	}
+
+	result := make(map[string]net.Listener)
+	for i, name := range names {
+		fd := firstInheritFD + i
+		file := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return result, fmt.Errorf("file descriptor %d (%s) is not a listening socket: %v", fd, name, err)
+		}
+		result[name] = ln
+	}
+	return result, nil
+}
+
+// restart starts a new instance of this binary with the same arguments,
+// hands it the listening sockets and waits until it is serving them.
+func restart() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, ln := range listeners {
+		filer, ok := ln.Listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s listener cannot be passed on", ln.name)
+		}
+		file, err := filer.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, ln.name)
+		files = append(files, file)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(os.Environ(),
+		envInheritedFDs+"="+strings.Join(names, ","),
+		fmt.Sprintf("%s=%d", envReadyFD, firstInheritFD+len(files)))
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+	slog.Info("Started new process, waiting until it is ready", "pid", cmd.Process.Pid)
+
+	// The pipe reaches EOF when the child closes it, either because it is
+	// ready or because it exited.
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	readDone := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := ready.Read(buf)
+		readDone <- buf[:n]
+	}()
+
+	select {
+	case msg := <-readDone:
+		if string(msg) == "ready" {
+			return nil
+		}
+		cmd.Process.Kill()
+		return fmt.Errorf("new process exited before it was ready: %v", <-exited)
+	case <-time.After(restartTimeout):
+		cmd.Process.Kill()
+		return errors.New("new process did not become ready in time")
+	}
+}
+
+// notifyReady tells a restarting parent and systemd that this process is
+// serving requests.
+func notifyReady() {
+	if value := os.Getenv(envReadyFD); value != "" {
+		os.Unsetenv(envReadyFD)
+		if fd, err := strconv.Atoi(value); err == nil {
+			file := os.NewFile(uintptr(fd), "ready")
+			file.Write([]byte("ready"))
+			file.Close()
+		}
+	}
+
+	// With NotifyAccess=all, systemd follows the main process across restarts.
+	if socket := os.Getenv("NOTIFY_SOCKET"); socket != "" {
+		conn, err := net.Dial("unixgram", socket)
+		if err != nil {
+			slog.Warn("Unable to notify systemd", "error", err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "READY=1\nMAINPID=%d\n", os.Getpid())
+	}
+}
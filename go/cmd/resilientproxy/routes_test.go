@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestRouteTablePrecedence(t *testing.T) {
+	table := newRouteTable([]*route{
+		{name: "any", index: 0},
+		{name: "files", pathPrefix: "/files/", index: 1},
+		{name: "files-big", pathPrefix: "/files/big/", index: 2},
+		{name: "iso", pathRegex: regexp.MustCompile(`\.iso$`), index: 3},
+		{name: "wildcard", host: "*.example.com", index: 4},
+		{name: "exact", host: "dl.example.com", pathPrefix: "/files/", index: 5},
+		{name: "files-again", pathPrefix: "/files/", index: 6},
+	})
+
+	tests := []struct {
+		host, path, want string
+	}{
+		{"localhost:3000", "/other", "any"},
+		{"localhost:3000", "/files/a", "files"},
+		{"localhost:3000", "/files/big/a", "files-big"},
+		{"localhost:3000", "/files/big/a.iso", "iso"},
+		{"www.example.com", "/files/big/a.iso", "wildcard"},
+		{"DL.example.com:443", "/files/a", "exact"},
+		{"dl.example.com", "/other", "wildcard"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Host = tt.host
+		if got := table.match(r); got == nil || got.name != tt.want {
+			t.Errorf("match(%s%s) = %v, want %s", tt.host, tt.path, got, tt.want)
+		}
+	}
+
+	table = newRouteTable([]*route{{name: "files", pathPrefix: "/files/"}})
+	if got := table.match(httptest.NewRequest("GET", "/other", nil)); got != nil {
+		t.Errorf("match(/other) = %s, want no route", got.name)
+	}
+}
+
+func TestRouteVerifiesUpstreams(t *testing.T) {
+	tests := []struct {
+		rt     *route
+		verify bool
+	}{
+		{&route{}, false},
+		{&route{forward: true}, true},
+		{&route{credentials: &credentials{kind: credentialsHeader}}, true},
+	}
+	for _, tt := range tests {
+		if got := !tt.rt.transport().TLSClientConfig.InsecureSkipVerify; got != tt.verify {
+			t.Errorf("transport of %+v verifies %v, want %v", tt.rt, got, tt.verify)
+		}
+	}
+}
+
+func TestRouteRewrite(t *testing.T) {
+	rt := &route{stripPrefix: "/files", addPrefix: "/generate"}
+	if got := rt.rewrite("/files/1000"); got != "/generate/1000" {
+		t.Errorf("rewrite(/files/1000) = %s, want /generate/1000", got)
+	}
+	if got := rt.rewrite("/other/1000"); got != "/generate/other/1000" {
+		t.Errorf("rewrite(/other/1000) = %s, want /generate/other/1000", got)
+	}
+}
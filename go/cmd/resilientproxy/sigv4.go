@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of the empty body of the proxy's GET and
+// HEAD requests.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// awsKeys are the credentials and scope of AWS Signature Version 4 signing.
+type awsKeys struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string // for temporary credentials, "" otherwise
+	region          string
+	service         string
+}
+
+// signV4 signs req with keys at now, adding the Authorization header. The
+// signature covers the host, the Range header of a resume, and the x-amz-*
+// headers, so an upstream rejects a request whose range was tampered with.
+func signV4(req *http.Request, keys awsKeys, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if keys.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", keys.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(strings.Fields(strings.Join(values, ",")), " ")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.Path, keys.service),
+		canonicalQuery(req.URL.RawQuery),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := date + "/" + keys.region + "/" + keys.service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := []byte("AWS4" + keys.secretAccessKey)
+	for _, part := range []string{date, keys.region, keys.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+keys.accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalURI encodes each segment of path; S3 encodes them once, every
+// other service twice.
+func canonicalURI(path, service string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+		if service != "s3" {
+			segments[i] = uriEncode(segments[i])
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery returns the query parameters sorted by name and value.
+func canonicalQuery(rawQuery string) string {
+	query, _ := url.ParseQuery(rawQuery)
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(name)+"="+uriEncode(value))
+		}
+	}
+	slices.Sort(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes every byte of s but the unreserved characters of
+// RFC 3986, as SigV4 requires.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
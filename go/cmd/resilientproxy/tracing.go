@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of client requests and upstream attempts. Until
+// tracing is set up it hands out no-op spans.
+var tracer = otel.Tracer("resilient-http-proxy")
+
+func init() {
+	// Trace context is propagated to the upstream even if no spans are
+	// exported, so a caller's trace continues past the proxy.
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// setupTracing exports spans via OTLP/HTTP to endpoint, or to the endpoint
+// in the standard OTEL_EXPORTER_OTLP_* variables if endpoint is empty. It
+// does nothing if neither is set. The returned function flushes pending
+// spans.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	} else if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	provider := newTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// newTracerProvider returns a provider for the proxy's spans that hands them
+// to the given span processor options (an exporter in tests).
+func newTracerProvider(opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	res := resource.NewSchemaless(semconv.ServiceName("resilientproxy"))
+	return sdktrace.NewTracerProvider(append(opts, sdktrace.WithResource(res))...)
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedBody ends the span of an upstream attempt once its response body has
+// been read to the end, failed or was closed, recording the bytes read.
+type tracedBody struct {
+	io.ReadCloser
+	span trace.Span
+	n    int64
+	once sync.Once
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF {
+		b.end(nil)
+	} else if err != nil {
+		b.end(err)
+	}
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	b.end(nil)
+	return b.ReadCloser.Close()
+}
+
+func (b *tracedBody) end(err error) {
+	b.once.Do(func() {
+		b.span.SetAttributes(attribute.Int64("http.response.body.size", b.n))
+		endSpan(b.span, err)
+	})
+}
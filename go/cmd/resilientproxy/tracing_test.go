@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTracingLinksClientRequestAndUpstreamAttempts(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := newTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var mu sync.Mutex
+	var traceparents []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		mu.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	server := httptest.NewServer(&proxy{routes: newRouteTable([]*route{{name: "default", upstreams: []string{upstream.URL}, retry: defaultRetryPolicy}})})
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/data", nil)
+	req.Header.Set("Range", "bytes=10-")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[10:]) {
+		t.Fatalf("unexpected response: status %d, %d bytes", resp.StatusCode, len(body))
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		if _, ok := spans[span.Name]; !ok {
+			spans[span.Name] = span
+		}
+	}
+	serverSpan, ok := spans["proxy GET"]
+	if !ok {
+		t.Fatalf("no server span in %v", spanNames(exporter.GetSpans()))
+	}
+	probe, ok := spans["range capability probe"]
+	if !ok {
+		t.Fatalf("no probe span in %v", spanNames(exporter.GetSpans()))
+	}
+	head, ok := spans["upstream HEAD"]
+	if !ok {
+		t.Fatalf("no HEAD attempt span in %v", spanNames(exporter.GetSpans()))
+	}
+	get, ok := spans["upstream GET"]
+	if !ok {
+		t.Fatalf("no GET attempt span in %v", spanNames(exporter.GetSpans()))
+	}
+
+	traceID := serverSpan.SpanContext.TraceID()
+	for _, span := range []tracetest.SpanStub{probe, head, get} {
+		if span.SpanContext.TraceID() != traceID {
+			t.Errorf("span %q is not part of the request's trace", span.Name)
+		}
+	}
+	if probe.Parent.SpanID() != serverSpan.SpanContext.SpanID() {
+		t.Errorf("probe span is not a child of the server span")
+	}
+	if head.Parent.SpanID() != probe.SpanContext.SpanID() {
+		t.Errorf("HEAD attempt span is not a child of the probe span")
+	}
+	if get.Parent.SpanID() != serverSpan.SpanContext.SpanID() {
+		t.Errorf("GET attempt span is not a child of the server span")
+	}
+
+	attrs := map[string]string{}
+	for _, kv := range get.Attributes {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["http.request.header.range"] != "bytes=10-" || attrs["http.response.status_code"] != "206" || attrs["http.request.resend_count"] != "0" {
+		t.Errorf("unexpected GET attempt attributes: %v", attrs)
+	}
+	attrs = map[string]string{}
+	for _, kv := range serverSpan.Attributes {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["resilientproxy.outcome"] != outcomeComplete || attrs["http.response.body.size"] != "9990" {
+		t.Errorf("unexpected server span attributes: %v", attrs)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, tp := range traceparents {
+		if !strings.Contains(tp, traceID.String()) {
+			t.Errorf("upstream got traceparent %q, want trace %s", tp, traceID)
+		}
+	}
+}
+
+func spanNames(spans tracetest.SpanStubs) []string {
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+	return names
+}
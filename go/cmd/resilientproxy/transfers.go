@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transfer is a client request or background download the proxy is
+// currently working on.
+type transfer struct {
+	id        uint64
+	requestID string
+	client    string
+	path      string
+	route     string
+	identity  string // of the authenticated client, "" if anonymous
+	started   time.Time
+
+	bytesSent atomic.Int64
+	status    atomic.Int32
+	firstByte atomic.Int64 // UnixNano of the first body byte sent, 0 before
+	lastTick  atomic.Int64 // UnixNano of the latest progress event
+	attempts  atomic.Int64 // upstream requests made
+	resumes   atomic.Int64
+	discarded atomic.Int64 // bytes re-downloaded and dropped for alignment
+	backoff   atomic.Int64 // nanoseconds spent waiting between retries
+	outcome   atomic.Value // string, one of the outcome constants
+
+	mu          sync.Mutex
+	upstreamURL string // of the latest upstream request
+	lastError   string // of the latest failed upstream request or read
+	etag        string
+	signedURL   string                  // replaces the upstream URL after re-signing
+	cancel      context.CancelCauseFunc // ends the whole transfer
+	interrupt   context.CancelCauseFunc // ends the current upstream attempt
+	upstreamCtx context.Context
+}
+
+var (
+	// errCancelled is the cancellation cause of a transfer cancelled through
+	// the admin API.
+	errCancelled = errors.New("transfer cancelled by admin")
+	// errReconnect ends the current upstream attempt of a transfer, which
+	// then resumes immediately.
+	errReconnect = errors.New("reconnect requested by admin")
+)
+
+// Final outcome of a transfer
+const (
+	outcomeComplete       = "complete"        // The whole response was sent
+	outcomeTruncated      = "truncated"       // The response ended early after the headers were sent
+	outcomeContentChanged = "content-changed" // The upstream content changed while resuming
+	outcomeAborted        = "aborted"         // The client went away or the server shut down
+	outcomeFailed         = "failed"          // No response could be obtained from the upstream
+)
+
+type transferKey struct{}
+
+// withTransfer returns a context carrying t, so the code working on the
+// transfer can record what it does.
+func withTransfer(ctx context.Context, t *transfer) context.Context {
+	return context.WithValue(ctx, transferKey{}, t)
+}
+
+// transferFrom returns the transfer of ctx. The result may be nil; all
+// recording methods accept a nil transfer.
+func transferFrom(ctx context.Context) *transfer {
+	t, _ := ctx.Value(transferKey{}).(*transfer)
+	return t
+}
+
+// clientKey returns what the client of t is known by: its identity, or its
+// address without the port if it is anonymous. The result is "" for a nil
+// transfer.
+func (t *transfer) clientKey() string {
+	if t == nil {
+		return ""
+	}
+	if t.identity != "" {
+		return t.identity
+	}
+	if host, _, err := net.SplitHostPort(t.client); err == nil {
+		return host
+	}
+	return t.client
+}
+
+func (t *transfer) countAttempt() {
+	if t != nil {
+		t.attempts.Add(1)
+	}
+}
+
+func (t *transfer) countResume() {
+	if t != nil {
+		t.resumes.Add(1)
+	}
+}
+
+func (t *transfer) countDiscarded(n int64) {
+	if t != nil {
+		t.discarded.Add(n)
+	}
+}
+
+func (t *transfer) countBackoff(d time.Duration) {
+	if t != nil {
+		t.backoff.Add(int64(d))
+	}
+}
+
+func (t *transfer) setUpstreamURL(url string) {
+	if t != nil {
+		t.mu.Lock()
+		t.upstreamURL = url
+		t.mu.Unlock()
+	}
+}
+
+func (t *transfer) setLastError(err error) {
+	if t != nil {
+		t.mu.Lock()
+		t.lastError = err.Error()
+		t.mu.Unlock()
+	}
+}
+
+func (t *transfer) setETag(etag string) {
+	if t != nil {
+		t.mu.Lock()
+		t.etag = etag
+		t.mu.Unlock()
+	}
+}
+
+func (t *transfer) setSignedURL(url string) {
+	if t != nil {
+		t.mu.Lock()
+		t.signedURL = url
+		t.mu.Unlock()
+	}
+}
+
+// getSignedURL returns the re-signed upstream URL of t, or "" if there is
+// none.
+func (t *transfer) getSignedURL() string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.signedURL
+}
+
+// upstreamContext returns the context for talking to the upstream on behalf
+// of the transfer of ctx: ctx itself, but ended early by forceReconnect. The
+// next call after a reconnect returns a fresh context.
+func upstreamContext(ctx context.Context) context.Context {
+	t := transferFrom(ctx)
+	if t == nil {
+		return ctx
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.upstreamCtx == nil || t.upstreamCtx.Err() != nil {
+		t.upstreamCtx, t.interrupt = context.WithCancelCause(ctx)
+	}
+	return t.upstreamCtx
+}
+
+// forceReconnect ends the current upstream attempt or backoff wait so the
+// transfer resumes right away.
+func (t *transfer) forceReconnect() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.interrupt != nil {
+		t.interrupt(errReconnect)
+	}
+}
+
+// abort cancels the transfer's context.
+func (t *transfer) abort() {
+	t.cancel(errCancelled)
+}
+
+func (t *transfer) setOutcome(outcome string) {
+	if t != nil {
+		t.outcome.Store(outcome)
+	}
+}
+
+// fail records that the transfer ended without the whole response: it was
+// truncated if the client already got the headers, and failed otherwise.
+func (t *transfer) fail() {
+	if t == nil {
+		return
+	}
+	if t.status.Load() != 0 {
+		t.setOutcome(outcomeTruncated)
+	} else {
+		t.setOutcome(outcomeFailed)
+	}
+}
+
+// getOutcome returns the recorded outcome, or one derived from err if
+// nothing was recorded.
+func (t *transfer) getOutcome(err error) string {
+	if outcome, ok := t.outcome.Load().(string); ok {
+		return outcome
+	}
+	if err != nil {
+		return outcomeFailed
+	}
+	return outcomeComplete
+}
+
+// transferRegistry keeps track of all active transfers so they can be
+// reported and waited for on shutdown.
+type transferRegistry struct {
+	mu      sync.Mutex
+	nextID  uint64
+	active  map[uint64]*transfer
+	changed chan struct{} // closed and replaced whenever a transfer ends
+}
+
+var activeTransfers = newTransferRegistry()
+
+func newTransferRegistry() *transferRegistry {
+	return &transferRegistry{
+		active:  make(map[uint64]*transfer),
+		changed: make(chan struct{}),
+	}
+}
+
+// begin registers a new transfer and returns it along with a context
+// derived from ctx that carries it and ends when it is aborted.
+func (reg *transferRegistry) begin(ctx context.Context, requestID, client, path, route string) (*transfer, context.Context) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.nextID++
+	identity, _ := identityFrom(ctx)
+	t := &transfer{id: reg.nextID, requestID: requestID, client: client, path: path, route: route, identity: identity, started: time.Now()}
+	ctx, t.cancel = context.WithCancelCause(ctx)
+	reg.active[t.id] = t
+	t.publish(eventStarted, nil)
+	return t, withTransfer(ctx, t)
+}
+
+func (reg *transferRegistry) end(t *transfer) {
+	t.cancel(context.Canceled)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.active, t.id)
+	close(reg.changed)
+	reg.changed = make(chan struct{})
+}
+
+// get returns the active transfer with the given ID, or nil.
+func (reg *transferRegistry) get(id uint64) *transfer {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.active[id]
+}
+
+// snapshot returns the active transfers, oldest first.
+func (reg *transferRegistry) snapshot() []*transfer {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	list := make([]*transfer, 0, len(reg.active))
+	for _, t := range reg.active {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// wait blocks until no transfers are active or ctx is done.
+func (reg *transferRegistry) wait(ctx context.Context) error {
+	for {
+		reg.mu.Lock()
+		n, changed := len(reg.active), reg.changed
+		reg.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// countingWriter records the status and counts the body bytes written to the
+// client of a transfer.
+type countingWriter struct {
+	http.ResponseWriter
+	transfer *transfer
+}
+
+func (cw *countingWriter) WriteHeader(statusCode int) {
+	cw.sendingHeader(statusCode)
+	cw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.sendingHeader(http.StatusOK)
+	now := time.Now().UnixNano()
+	cw.transfer.firstByte.CompareAndSwap(0, now)
+	n, err := cw.ResponseWriter.Write(p)
+	cw.sent(now, int64(n))
+	return n, err
+}
+
+// ReadFrom lets the client connection read from src directly, so the runtime
+// can splice or sendfile. Bytes are counted as they are read, which keeps the
+// progress current, and corrected to those written once the copy ends. A
+// chunk of a file is only counted at the end, so sendfile still sees the file.
+func (cw *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	cw.sendingHeader(http.StatusOK)
+	if lr, ok := src.(*io.LimitedReader); ok {
+		if _, ok := lr.R.(*os.File); ok {
+			now := time.Now().UnixNano()
+			cw.transfer.firstByte.CompareAndSwap(0, now)
+			n, err := readFrom(cw.ResponseWriter, src)
+			cw.sent(now, n)
+			return n, err
+		}
+	}
+	counter := &countingReader{Reader: src, writer: cw}
+	n, err := readFrom(cw.ResponseWriter, counter)
+	cw.transfer.bytesSent.Add(n - counter.n)
+	return n, err
+}
+
+// sent counts n body bytes written at now.
+func (cw *countingWriter) sent(now, n int64) {
+	cw.transfer.bytesSent.Add(n)
+	if last := cw.transfer.lastTick.Load(); now-last >= int64(progressInterval) && cw.transfer.lastTick.CompareAndSwap(last, now) {
+		cw.transfer.publish(eventProgress, nil)
+	}
+}
+
+// countingReader counts the bytes read for a countingWriter's ReadFrom as
+// sent.
+type countingReader struct {
+	io.Reader
+	writer *countingWriter
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		now := time.Now().UnixNano()
+		r.writer.transfer.firstByte.CompareAndSwap(0, now)
+		r.writer.sent(now, int64(n))
+		r.n += int64(n)
+	}
+	return n, err
+}
+
+// sendingHeader records the status of the response unless it is already
+// known.
+func (cw *countingWriter) sendingHeader(statusCode int) {
+	if !cw.transfer.status.CompareAndSwap(0, int32(statusCode)) {
+		return
+	}
+	cw.transfer.publish(eventHeaders, func(e *transferEvent) {
+		e.Status = statusCode
+		e.ContentLength, _ = strconv.ParseInt(cw.Header().Get("Content-Length"), 10, 64)
+	})
+}
+
+// observe records the metrics of a finished client request.
+func (t *transfer) observe() {
+	requestsTotal.WithLabelValues(t.route, strconv.Itoa(int(t.status.Load()))).Inc()
+	if t.identity != "" {
+		authenticatedRequests.WithLabelValues(t.identity, t.route).Inc()
+	}
+	if firstByte := t.firstByte.Load(); firstByte != 0 {
+		timeToFirstByte.WithLabelValues(t.route).Observe(time.Unix(0, firstByte).Sub(t.started).Seconds())
+	}
+	transferDuration.WithLabelValues(t.route).Observe(time.Since(t.started).Seconds())
+}
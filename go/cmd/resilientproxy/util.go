@@ -1,7 +1,32 @@
 package main
 
-import "log"
+import (
+	"context"
+	"time"
 
-func logUpstream(format string, v ...interface{}) {
-	log.Printf("\t\t"+format, v...)
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sleepContext waits for d or until ctx is done, whichever comes first.
+// It returns the context's error if the wait was cut short. The time waited
+// is recorded on the transfer and the current span of ctx.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	start := time.Now()
+	defer func() {
+		waited := time.Since(start)
+		transferFrom(ctx).countBackoff(waited)
+		trace.SpanFromContext(ctx).AddEvent("backoff", trace.WithAttributes(
+			attribute.Int64("resilientproxy.backoff_delay_ms", d.Milliseconds()),
+			attribute.Int64("resilientproxy.backoff_waited_ms", waited.Milliseconds())))
+	}()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook notification kinds
+const (
+	notifyRetriesExhausted = "retries_exhausted"       // A transfer was given up
+	notifyContentChanged   = "content_changed"         // A transfer was aborted because the upstream content changed
+	notifyCircuitOpen      = "circuit_open"            // An upstream stopped answering
+	notifyCircuitClosed    = "circuit_closed"          // An upstream answers again
+	notifyRecovered        = "completed_after_resumes" // A transfer completed after many resumes
+)
+
+var notificationKinds = []string{notifyRetriesExhausted, notifyContentChanged, notifyCircuitOpen, notifyCircuitClosed, notifyRecovered}
+
+const webhookQueueSize = 1000 // Notifications waiting per sink before they go to the dead-letter file
+
+// notification is the JSON body POSTed to webhook sinks. Fields that do not
+// apply to a kind are omitted.
+type notification struct {
+	Kind        string        `json:"event"`
+	Time        time.Time     `json:"time"`
+	RequestID   string        `json:"request_id,omitempty"`
+	Client      string        `json:"client,omitempty"`
+	Path        string        `json:"path,omitempty"`
+	UpstreamURL string        `json:"upstream_url,omitempty"`
+	Upstream    string        `json:"upstream,omitempty"`
+	BytesSent   int64         `json:"bytes_sent,omitempty"`
+	Attempts    int64         `json:"upstream_attempts,omitempty"`
+	Resumes     int64         `json:"resumes,omitempty"`
+	ETag        string        `json:"etag,omitempty"`
+	Failures    int           `json:"failures,omitempty"`
+	Downtime    time.Duration `json:"downtime_ns,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// webhookSink is a URL notified of some or all notification kinds.
+type webhookSink struct {
+	url   string
+	kinds map[string]bool // nil for all kinds
+	queue chan notification
+}
+
+// webhookNotifier delivers notifications to the configured sinks. Each sink
+// gets its notifications in order; a notification that cannot be delivered
+// after the configured retries is appended to the dead-letter file.
+type webhookNotifier struct {
+	ctx        context.Context
+	stop       context.CancelFunc
+	sinks      []*webhookSink
+	retries    int
+	minResumes int64
+	client     *http.Client
+	wg         sync.WaitGroup
+
+	queueMu sync.Mutex
+	closed  bool // no more notifications are queued after shutdown
+
+	mu         sync.Mutex
+	deadLetter string
+}
+
+// notifier sends the proxy's webhook notifications; nil if none are
+// configured.
+var notifier *webhookNotifier
+
+// newWebhookNotifier starts delivering to the sinks given as "URL" or
+// "KIND,KIND=URL". Transfers that complete after at least minResumes resumes
+// are reported as recovered.
+func newWebhookNotifier(specs []string, deadLetter string, retries int, minResumes int64) (*webhookNotifier, error) {
+	ctx, stop := context.WithCancel(context.Background())
+	n := &webhookNotifier{
+		ctx:        ctx,
+		stop:       stop,
+		retries:    retries,
+		minResumes: minResumes,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		deadLetter: deadLetter,
+	}
+	for _, spec := range specs {
+		sink := &webhookSink{url: spec, queue: make(chan notification, webhookQueueSize)}
+		if kinds, url, found := strings.Cut(spec, "="); found && !strings.ContainsAny(kinds, ":/") {
+			sink.url, sink.kinds = url, make(map[string]bool)
+			for _, kind := range strings.Split(kinds, ",") {
+				if !isNotificationKind(kind) {
+					return nil, fmt.Errorf("unknown webhook event %q, expected one of %s", kind, strings.Join(notificationKinds, ", "))
+				}
+				sink.kinds[kind] = true
+			}
+		}
+		if !strings.HasPrefix(sink.url, "http://") && !strings.HasPrefix(sink.url, "https://") {
+			return nil, fmt.Errorf("invalid webhook URL %q", sink.url)
+		}
+		n.sinks = append(n.sinks, sink)
+	}
+	if err := os.MkdirAll(filepath.Dir(deadLetter), 0755); err != nil {
+		return nil, fmt.Errorf("unable to create dead-letter directory: %v", err)
+	}
+	for _, sink := range n.sinks {
+		n.wg.Add(1)
+		go n.run(sink)
+	}
+	return n, nil
+}
+
+func isNotificationKind(kind string) bool {
+	for _, k := range notificationKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// notify queues a notification of the given kind for the sinks interested
+// in it. set fills in the fields specific to the kind.
+func (n *webhookNotifier) notify(kind string, set func(*notification)) {
+	if n == nil {
+		return
+	}
+	note := notification{Kind: kind, Time: time.Now()}
+	set(&note)
+	n.queueMu.Lock()
+	defer n.queueMu.Unlock()
+	for _, sink := range n.sinks {
+		if sink.kinds != nil && !sink.kinds[kind] {
+			continue
+		}
+		if n.closed {
+			n.bury(sink, note, fmt.Errorf("shutting down"))
+			continue
+		}
+		select {
+		case sink.queue <- note:
+		default:
+			n.bury(sink, note, fmt.Errorf("queue full"))
+		}
+	}
+}
+
+// notifyTransfer queues a notification about the transfer of ctx.
+func notifyTransfer(ctx context.Context, kind string, err error) {
+	t := transferFrom(ctx)
+	if notifier == nil || t == nil {
+		return
+	}
+	info := t.info()
+	notifier.notify(kind, func(note *notification) {
+		note.RequestID = info.RequestID
+		note.Client = info.Client
+		note.Path = info.Path
+		note.UpstreamURL = info.UpstreamURL
+		note.BytesSent = info.BytesSent
+		note.Attempts = info.Attempt
+		note.Resumes = info.Resumes
+		note.ETag = info.ETag
+		if err != nil {
+			note.Error = err.Error()
+		}
+	})
+}
+
+// transferEnded reports a transfer that completed after enough resumes.
+func (n *webhookNotifier) transferEnded(t *transfer, err error) {
+	if n == nil || t.resumes.Load() < n.minResumes || t.getOutcome(err) != outcomeComplete {
+		return
+	}
+	notifyTransfer(withTransfer(context.Background(), t), notifyRecovered, nil)
+}
+
+// run delivers the notifications of sink until the notifier is shut down.
+func (n *webhookNotifier) run(sink *webhookSink) {
+	defer n.wg.Done()
+	for note := range sink.queue {
+		err := n.deliver(sink, note)
+		for attempt := 1; err != nil && attempt <= n.retries; attempt++ {
+			slog.Warn("Webhook delivery failed, retrying", "url", sink.url, "event", note.Kind, "attempt", attempt, "error", err)
+			if sleepContext(n.ctx, retryDelay*time.Duration(1<<(attempt-1))) != nil {
+				break
+			}
+			err = n.deliver(sink, note)
+		}
+		if err != nil {
+			n.bury(sink, note, err)
+		}
+	}
+}
+
+// deliver POSTs note to sink once.
+func (n *webhookNotifier) deliver(sink *webhookSink, note notification) error {
+	if n.ctx.Err() != nil {
+		return n.ctx.Err()
+	}
+	body, err := json.Marshal(note)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(n.ctx, http.MethodPost, sink.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if note.RequestID != "" {
+		req.Header.Set(requestIDHeader, note.RequestID)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// bury appends an undeliverable notification to the dead-letter file.
+func (n *webhookNotifier) bury(sink *webhookSink, note notification, err error) {
+	slog.Error("Webhook notification undeliverable, writing it to the dead-letter file",
+		"url", sink.url, "event", note.Kind, "file", n.deadLetter, "error", err)
+	line, _ := json.Marshal(struct {
+		URL          string       `json:"url"`
+		Error        string       `json:"error"`
+		Notification notification `json:"notification"`
+	}{sink.url, err.Error(), note})
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	file, openErr := os.OpenFile(n.deadLetter, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if openErr != nil {
+		slog.Error("Unable to open the dead-letter file", "file", n.deadLetter, "error", openErr)
+		return
+	}
+	defer file.Close()
+	file.Write(append(line, '\n'))
+}
+
+// shutdown delivers the queued notifications until ctx is done and writes
+// the rest to the dead-letter file.
+func (n *webhookNotifier) shutdown(ctx context.Context) {
+	if n == nil {
+		return
+	}
+	n.queueMu.Lock()
+	n.closed = true
+	for _, sink := range n.sinks {
+		close(sink.queue)
+	}
+	n.queueMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		n.stop()
+		<-done
+	}
+}
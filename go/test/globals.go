@@ -9,8 +9,10 @@ const (
 	BlockSize    = 10000
 	Blocks       = 10
 	ProxyPort    = 3000
+	AdminPort    = 3001
 	CompleteSize = BlockSize * Blocks
 )
 
 var BaseURLBackend = fmt.Sprintf("http://127.0.0.1:%d", BackendPort)
 var BaseURLProxy = fmt.Sprintf("http://127.0.0.1:%d", ProxyPort)
+var BaseURLAdmin = fmt.Sprintf("http://127.0.0.1:%d", AdminPort)
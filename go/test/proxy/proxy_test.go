@@ -1,14 +1,35 @@
 package test_proxy
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"resilient-http-proxy/test"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestProxyFunctionality(t *testing.T) {
@@ -345,3 +366,2088 @@ func setupProxyTest(t *testing.T, options ...interface{}) {
 	test.StartBackendService(t, backendOpts...)
 	test.StartProxyService(t, proxyOpts...)
 }
+
+func TestProxyAbandonsTransferWhenClientDisconnects(t *testing.T) {
+	setupProxyTest(t,
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10),
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", fmt.Sprintf("%d", test.AdminPort)))
+
+	resp, err := http.Get(fmt.Sprintf("%s/generate/%d", test.BaseURLProxy, test.CompleteSize))
+	if err != nil {
+		t.Fatalf("Failed to fetch data: %v", err)
+	}
+	if _, err := io.CopyN(io.Discard, resp.Body, test.CompleteSize/10); err != nil {
+		t.Fatalf("Failed to read first chunk: %v", err)
+	}
+
+	// Drop the client connection in the middle of the transfer
+	resp.Body.Close()
+	time.Sleep(2 * time.Second)
+
+	abandoned := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", `resilientproxy_abandoned_transfers_total{reason="client_gone"}`)
+	if abandoned != 1 {
+		t.Fatalf("Expected 1 transfer abandoned by the client, got %v", abandoned)
+	}
+}
+
+func TestProxyCompletesDetachedDownloadAfterClientDisconnects(t *testing.T) {
+	setupProxyTest(t,
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10),
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs(
+			"-adminPort", fmt.Sprintf("%d", test.AdminPort),
+			"-detached", "/generate/",
+			"-cacheDir", test.DataDir+"/cache"))
+
+	url := fmt.Sprintf("%s/generate/%d", test.BaseURLProxy, test.CompleteSize)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to fetch data: %v", err)
+	}
+	out, err := os.Create(test.CompleteFile)
+	if err != nil {
+		t.Fatalf("Failed to create complete file: %v", err)
+	}
+	defer out.Close()
+	received, err := io.CopyN(out, resp.Body, 2*test.BlockSize)
+	if err != nil {
+		t.Fatalf("Failed to read first blocks: %v", err)
+	}
+
+	// Drop the client connection and come back later, like curl -C -
+	resp.Body.Close()
+	time.Sleep(3 * time.Second)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("Failed to create range request: %v", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", received))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to resume download: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected status code 206, got %d", resp.StatusCode)
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		t.Fatalf("Failed to read remaining data: %v", err)
+	}
+
+	started := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", `resilientproxy_detached_downloads_total{event="started"}`)
+	joined := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", `resilientproxy_detached_downloads_total{event="joined"}`)
+	if started != 1 || joined != 1 {
+		t.Fatalf("Expected the second request to join the first download, got started=%v joined=%v", started, joined)
+	}
+
+	sha1Resumed := test.CalculateSHA1(t, test.CompleteFile)
+	test.FetchCompleteFile(t, test.BaseURLBackend)
+	sha1Backend := test.CalculateSHA1(t, test.CompleteFile)
+	if sha1Resumed != sha1Backend {
+		t.Fatalf("SHA1 mismatch: resumed=%s, backend=%s", sha1Resumed, sha1Backend)
+	}
+}
+
+func TestProxyKeysDetachedDownloadsByQuery(t *testing.T) {
+	var queries sync.Map
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Store(r.URL.RawQuery, true)
+		http.ServeContent(w, r, "f", time.Unix(0, 0), strings.NewReader("version "+r.URL.Query().Get("v")))
+	}))
+	defer origin.Close()
+	test.StartProxyService(t,
+		test.WithProxyUpstream(origin.URL),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", strconv.Itoa(test.AdminPort), "-detached", "/", "-cacheDir", test.DataDir+"/cache"))
+
+	for _, v := range []string{"1", "2"} {
+		resp, err := http.Get(test.BaseURLProxy + "/f?v=" + v)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "version "+v {
+			t.Errorf("Expected %q, got %d %q", "version "+v, resp.StatusCode, body)
+		}
+		if _, ok := queries.Load("v=" + v); !ok {
+			t.Errorf("Expected the query v=%s to reach the upstream", v)
+		}
+	}
+	if started := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", `resilientproxy_detached_downloads_total{event="started"}`); started != 2 {
+		t.Errorf("Expected a download per query, got %v", started)
+	}
+}
+
+func TestProxyListsDetachedDownloadsUnderTheirRoute(t *testing.T) {
+	const routesFile = "/tmp/routes.json"
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(2*test.BlockSize))
+		w.Write(make([]byte, test.BlockSize))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(make([]byte, test.BlockSize))
+	}))
+	defer origin.Close()
+	defer close(release)
+	os.WriteFile(routesFile, fmt.Appendf(nil, `{"routes": [{"name": "mirror", "upstreams": [%q], "cache": "detached"}]}`, origin.URL), 0644)
+	defer os.Remove(routesFile)
+	test.CreateDataDir(t)
+	test.StartProxyService(t,
+		test.WithProxyUpstream(""),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", strconv.Itoa(test.AdminPort), "-adminToken", "admin-token",
+			"-routes", routesFile, "-cacheDir", test.DataDir+"/cache"))
+
+	resp, err := http.Get(test.BaseURLProxy + "/f")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The client request and the background download it started
+	req, _ := http.NewRequest("GET", test.BaseURLAdmin+"/transfers", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	list, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Listing transfers failed: %v", err)
+	}
+	var transfers []struct {
+		Client string `json:"client"`
+		Route  string `json:"route"`
+	}
+	err = json.NewDecoder(list.Body).Decode(&transfers)
+	list.Body.Close()
+	if err != nil || len(transfers) != 2 {
+		t.Fatalf("Expected two transfers, got %+v, %v", transfers, err)
+	}
+	for _, transfer := range transfers {
+		if transfer.Route != "mirror" {
+			t.Errorf("Expected the transfer of %s under the route mirror, got %q", transfer.Client, transfer.Route)
+		}
+	}
+}
+
+func TestProxyDrainsActiveTransfersOnShutdown(t *testing.T) {
+	test.CreateDataDir(t)
+	test.StartBackendService(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10))
+	cmdProxy := test.StartProxyService(t,
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-drainTimeout", "30s"))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- test.FetchData(test.BaseURLProxy, test.CompleteSize, test.CompleteFile)
+	}()
+
+	time.Sleep(2 * time.Second)
+	if err := cmdProxy.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to signal proxy: %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// New connections are refused while the active transfer drains
+	if _, err := http.Get(fmt.Sprintf("%s/generate/%d", test.BaseURLProxy, test.BlockSize)); err == nil {
+		t.Fatalf("Expected the proxy to refuse new connections while draining")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Download failed during shutdown: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download timed out during shutdown")
+	}
+	if err := cmdProxy.Wait(); err != nil {
+		t.Fatalf("Expected the proxy to exit cleanly, got: %v", err)
+	}
+
+	sha1Drained := test.CalculateSHA1(t, test.CompleteFile)
+	test.FetchCompleteFile(t, test.BaseURLBackend)
+	sha1Backend := test.CalculateSHA1(t, test.CompleteFile)
+	if sha1Drained != sha1Backend {
+		t.Fatalf("SHA1 mismatch: drained=%s, backend=%s", sha1Drained, sha1Backend)
+	}
+}
+
+func TestProxyAbortsTransfersAfterDrainTimeout(t *testing.T) {
+	test.CreateDataDir(t)
+	test.StartBackendService(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10))
+	cmdProxy := test.StartProxyService(t,
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-drainTimeout", "1s"))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- test.FetchData(test.BaseURLProxy, test.CompleteSize, test.CompleteFile)
+	}()
+
+	time.Sleep(2 * time.Second)
+	if err := cmdProxy.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to signal proxy: %v", err)
+	}
+
+	err := cmdProxy.Wait()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 2 {
+		t.Fatalf("Expected the proxy to exit with status 2, got: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Expected the download to be cut off by the drain timeout")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Download was not aborted after the drain timeout")
+	}
+}
+
+func TestProxyRestartsWithoutDroppingConnections(t *testing.T) {
+	const pidFile = "/tmp/proxy.pid"
+	test.CreateDataDir(t)
+	test.StartBackendService(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10))
+	cmdProxy := test.StartProxyService(t,
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-pidFile", pidFile))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- test.FetchData(test.BaseURLProxy, test.CompleteSize, test.CompleteFile)
+	}()
+
+	time.Sleep(2 * time.Second)
+	if err := cmdProxy.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatalf("Failed to signal proxy: %v", err)
+	}
+	time.Sleep(2 * time.Second)
+
+	content, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("Failed to read pid file: %v", err)
+	}
+	newPid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || newPid == cmdProxy.Process.Pid {
+		t.Fatalf("Expected a new process to write the pid file, got %q", content)
+	}
+	t.Cleanup(func() {
+		if process, err := os.FindProcess(newPid); err == nil {
+			process.Kill()
+		}
+	})
+
+	// The new process accepts requests while the old one drains
+	resp, err := http.Get(fmt.Sprintf("%s/generate/%d", test.BaseURLProxy, test.BlockSize))
+	if err != nil {
+		t.Fatalf("Failed to fetch data during restart: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code 200 during restart, got %d", resp.StatusCode)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Download failed during restart: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download timed out during restart")
+	}
+	if err := cmdProxy.Wait(); err != nil {
+		t.Fatalf("Expected the old process to exit cleanly, got: %v", err)
+	}
+
+	sha1Restarted := test.CalculateSHA1(t, test.CompleteFile)
+	test.FetchCompleteFile(t, test.BaseURLProxy)
+	sha1Complete := test.CalculateSHA1(t, test.CompleteFile)
+	if sha1Restarted != sha1Complete {
+		t.Fatalf("SHA1 mismatch: restarted=%s, complete=%s", sha1Restarted, sha1Complete)
+	}
+}
+
+func TestProxyExposesMetrics(t *testing.T) {
+	test.CreateDataDir(t)
+
+	cmdBackend := test.StartBackendService(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10))
+
+	test.StartProxyService(t,
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", fmt.Sprintf("%d", test.AdminPort)))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- test.FetchData(test.BaseURLProxy, test.CompleteSize, test.CompleteFile)
+	}()
+
+	time.Sleep(2 * time.Second)
+	metricsURL := test.BaseURLAdmin + "/metrics"
+	if active := test.FetchMetric(t, metricsURL, "resilientproxy_active_transfers"); active != 1 {
+		t.Fatalf("Expected 1 active transfer, got %v", active)
+	}
+
+	cmdBackend.Process.Kill()
+	time.Sleep(2 * time.Second)
+	test.StartBackendService(t, test.WithBackendLogFile("/tmp/backend.log"))
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Download failed after backend crash: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download timed out after backend crash")
+	}
+
+	expected := map[string]float64{
+		`resilientproxy_requests_total{code="200",route="default"}`:       1,
+		`resilientproxy_resumes_total{method="range"}`:                    1,
+		`resilientproxy_transfer_duration_seconds_count{route="default"}`: 1,
+		"resilientproxy_active_transfers":                                 0,
+	}
+	for series, want := range expected {
+		if got := test.FetchMetric(t, metricsURL, series); got != want {
+			t.Errorf("Expected %s to be %v, got %v", series, want, got)
+		}
+	}
+	if retried := test.FetchMetric(t, metricsURL, `resilientproxy_upstream_attempts_total{outcome="retry"}`); retried < 1 {
+		t.Errorf("Expected failed upstream attempts to be counted, got %v", retried)
+	}
+}
+
+func TestProxyLogsWithRequestIDs(t *testing.T) {
+	setupProxyTest(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", fmt.Sprintf("%d", test.AdminPort), "-logFormat", "json", "-adminToken", "admin-token"))
+
+	// Switch to debug logging at runtime to get the headers logged
+	req, err := http.NewRequest("PUT", test.BaseURLAdmin+"/loglevel", strings.NewReader("debug"))
+	if err != nil {
+		t.Fatalf("Failed to create log level request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer admin-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to change log level: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code 200 when changing the log level, got %d", resp.StatusCode)
+	}
+
+	req, err = http.NewRequest("GET", fmt.Sprintf("%s/generate/%d", test.BaseURLProxy, test.BlockSize), nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("X-Request-ID", "test-request-1")
+	req.Header.Set("Authorization", "Bearer top-secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to fetch data: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if id := resp.Header.Get("X-Request-ID"); id != "test-request-1" {
+		t.Fatalf("Expected the request ID to be echoed, got %q", id)
+	}
+
+	proxyLog, err := os.ReadFile("/tmp/proxy.log")
+	if err != nil {
+		t.Fatalf("Failed to read proxy log: %v", err)
+	}
+	if strings.Contains(string(proxyLog), "top-secret") {
+		t.Fatalf("Expected the Authorization header to be redacted in the proxy log")
+	}
+	upstreamLines := 0
+	for _, line := range strings.Split(string(proxyLog), "\n") {
+		if strings.Contains(line, `"msg":"Fetching from upstream"`) {
+			if !strings.Contains(line, `"request_id":"test-request-1"`) {
+				t.Fatalf("Expected upstream log line to carry the request ID: %s", line)
+			}
+			upstreamLines++
+		}
+	}
+	if upstreamLines == 0 {
+		t.Fatalf("Expected upstream requests to be logged")
+	}
+
+	backendLog, err := os.ReadFile("/tmp/backend.log")
+	if err != nil {
+		t.Fatalf("Failed to read backend log: %v", err)
+	}
+	if !strings.Contains(string(backendLog), "X-Request-Id: [test-request-1]") {
+		t.Fatalf("Expected the request ID to be passed to the upstream")
+	}
+}
+
+func TestProxyWritesAccessLog(t *testing.T) {
+	const accessLog = "/tmp/access.log"
+	os.Remove(accessLog)
+	test.CreateDataDir(t)
+
+	cmdBackend := test.StartBackendService(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10))
+
+	test.StartProxyService(t,
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-accessLog", accessLog, "-accessLogFormat", "json"))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- test.FetchData(test.BaseURLProxy, test.CompleteSize, test.CompleteFile)
+	}()
+
+	time.Sleep(2 * time.Second)
+	cmdBackend.Process.Kill()
+	time.Sleep(2 * time.Second)
+	test.StartBackendService(t, test.WithBackendLogFile("/tmp/backend.log"))
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Download failed after backend crash: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Download timed out after backend crash")
+	}
+
+	// The entry is written once the handler returns, which may be just after
+	// the client has read the last byte.
+	var content []byte
+	for deadline := time.Now().Add(5 * time.Second); len(content) == 0 && time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		var err error
+		if content, err = os.ReadFile(accessLog); err != nil {
+			t.Fatalf("Failed to read access log: %v", err)
+		}
+	}
+	var entry struct {
+		Method    string `json:"method"`
+		URI       string `json:"uri"`
+		Status    int    `json:"status"`
+		BytesSent int64  `json:"bytes_sent"`
+		Attempts  int64  `json:"upstream_attempts"`
+		Resumes   int64  `json:"resumes"`
+		Outcome   string `json:"outcome"`
+	}
+	if err := json.Unmarshal(content, &entry); err != nil {
+		t.Fatalf("Failed to parse access log entry %q: %v", content, err)
+	}
+	if entry.Method != "GET" || entry.URI != fmt.Sprintf("/generate/%d", test.CompleteSize) || entry.Status != http.StatusOK {
+		t.Errorf("Unexpected request in access log: %+v", entry)
+	}
+	if entry.BytesSent != test.CompleteSize || entry.Outcome != "complete" {
+		t.Errorf("Expected a complete transfer of %d bytes, got %+v", test.CompleteSize, entry)
+	}
+	if entry.Resumes != 1 || entry.Attempts < 3 {
+		t.Errorf("Expected the resume and the failed attempts to be logged, got %+v", entry)
+	}
+
+	// Queries are left out, as they may hold signatures
+	resp, err := http.Get(test.BaseURLProxy + "/generate/1000?X-Amz-Signature=secret")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	for deadline := time.Now().Add(5 * time.Second); bytes.Count(content, []byte("\n")) < 2 && time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		content, _ = os.ReadFile(accessLog)
+	}
+	if !bytes.Contains(content, []byte(`"uri":"/generate/1000?[REDACTED]"`)) || bytes.Contains(content, []byte("secret")) {
+		t.Errorf("Expected the query to be redacted in the access log, got %q", content)
+	}
+}
+
+func TestProxyAdminAPIReconnectsAndCancelsTransfers(t *testing.T) {
+	const token = "test-admin-token"
+	setupProxyTest(t,
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10),
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", fmt.Sprintf("%d", test.AdminPort), "-adminToken", token))
+
+	admin := func(method, path string, authorized bool) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, test.BaseURLAdmin+path, nil)
+		if err != nil {
+			t.Fatalf("Failed to create admin request: %v", err)
+		}
+		if authorized {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Admin request %s %s failed: %v", method, path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	type transferInfo struct {
+		ID          uint64 `json:"id"`
+		UpstreamURL string `json:"upstream_url"`
+		BytesSent   int64  `json:"bytes_sent"`
+		Attempt     int64  `json:"attempt"`
+		Resumes     int64  `json:"resumes"`
+		ETag        string `json:"etag"`
+		LastError   string `json:"last_error"`
+	}
+
+	path := fmt.Sprintf("/generate/%d", test.CompleteSize)
+	resp, err := http.Get(test.BaseURLProxy + path)
+	if err != nil {
+		t.Fatalf("Failed to fetch data: %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.CopyN(io.Discard, resp.Body, test.CompleteSize/10); err != nil {
+		t.Fatalf("Failed to read first chunk: %v", err)
+	}
+
+	if resp := admin("GET", "/transfers", false); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status code 401 without token, got %d", resp.StatusCode)
+	}
+	var transfers []transferInfo
+	if err := json.NewDecoder(admin("GET", "/transfers", true).Body).Decode(&transfers); err != nil {
+		t.Fatalf("Failed to decode transfers: %v", err)
+	}
+	if len(transfers) != 1 {
+		t.Fatalf("Expected 1 active transfer, got %+v", transfers)
+	}
+	transfer := transfers[0]
+	if !strings.HasSuffix(transfer.UpstreamURL, path) || transfer.BytesSent < test.CompleteSize/10 || transfer.Attempt != 1 || transfer.ETag == "" {
+		t.Errorf("Unexpected transfer: %+v", transfer)
+	}
+
+	// Force a reconnect; the transfer resumes without the client noticing
+	transferPath := fmt.Sprintf("/transfers/%d", transfer.ID)
+	if resp := admin("POST", transferPath+"/reconnect", true); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status code 202 for reconnect, got %d", resp.StatusCode)
+	}
+	if _, err := io.CopyN(io.Discard, resp.Body, test.CompleteSize/5); err != nil {
+		t.Fatalf("Failed to read after reconnect: %v", err)
+	}
+	if err := json.NewDecoder(admin("GET", transferPath, true).Body).Decode(&transfer); err != nil {
+		t.Fatalf("Failed to decode transfer: %v", err)
+	}
+	if transfer.Resumes != 1 || transfer.Attempt != 2 || transfer.LastError == "" {
+		t.Errorf("Expected one resume after the reconnect, got %+v", transfer)
+	}
+
+	// Cancel the transfer; the client must see a truncated response
+	if resp := admin("POST", transferPath+"/cancel", true); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status code 202 for cancel, got %d", resp.StatusCode)
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err == nil {
+		t.Fatalf("Expected the cancelled transfer to end with an error")
+	}
+	time.Sleep(500 * time.Millisecond)
+	if resp := admin("GET", transferPath, true); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status code 404 for a finished transfer, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxyStreamsTransferEvents(t *testing.T) {
+	test.CreateDataDir(t)
+	cmdBackend := test.StartBackendService(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10))
+	test.StartProxyService(t,
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", fmt.Sprintf("%d", test.AdminPort)))
+
+	stream, err := http.Get(test.BaseURLAdmin + "/events?request_id=events-test")
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer stream.Body.Close()
+	if contentType := stream.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", contentType)
+	}
+	type event struct {
+		Type      string `json:"type"`
+		RequestID string `json:"request_id"`
+		BytesSent int64  `json:"bytes_sent"`
+		Delay     int64  `json:"delay_ns"`
+		Offset    int64  `json:"offset"`
+		Outcome   string `json:"outcome"`
+	}
+	events := make(chan event, 1000)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(stream.Body)
+		for scanner.Scan() {
+			data, found := strings.CutPrefix(scanner.Text(), "data: ")
+			if !found {
+				continue
+			}
+			var e event
+			if err := json.Unmarshal([]byte(data), &e); err == nil {
+				events <- e
+			}
+		}
+	}()
+
+	// An unrelated request must be filtered out
+	if err := test.FetchData(test.BaseURLProxy, test.BlockSize, test.DataDir+"/other"); err != nil {
+		t.Fatalf("Failed to fetch other data: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/generate/%d", test.BaseURLProxy, test.CompleteSize), nil)
+		req.Header.Set("X-Request-ID", "events-test")
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			_, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	time.Sleep(2 * time.Second)
+	cmdBackend.Process.Kill()
+	time.Sleep(2 * time.Second)
+	test.StartBackendService(t, test.WithBackendLogFile("/tmp/backend.log"))
+	if err := <-done; err != nil {
+		t.Fatalf("Download failed after backend crash: %v", err)
+	}
+
+	var types []string
+	seen := map[string]event{}
+	timeout := time.After(10 * time.Second)
+	for seen["completed"].Type == "" {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("Event stream ended early after %v", types)
+			}
+			if e.RequestID != "events-test" {
+				t.Fatalf("Expected only events of the filtered request, got %+v", e)
+			}
+			types = append(types, e.Type)
+			if _, ok := seen[e.Type]; !ok {
+				seen[e.Type] = e
+			}
+		case <-timeout:
+			t.Fatalf("No completed event, got %v", types)
+		}
+	}
+	for _, typ := range []string{"started", "headers", "progress", "upstream_error", "retry_scheduled", "resumed", "completed"} {
+		if _, ok := seen[typ]; !ok {
+			t.Errorf("Expected a %s event, got %v", typ, types)
+		}
+	}
+	if types[0] != "started" || types[len(types)-1] != "completed" {
+		t.Errorf("Expected the events to start with started and end with completed, got %v", types)
+	}
+	if seen["retry_scheduled"].Delay <= 0 || seen["resumed"].Offset <= 0 {
+		t.Errorf("Expected the retry delay and resume offset, got %+v and %+v", seen["retry_scheduled"], seen["resumed"])
+	}
+	if completed := seen["completed"]; completed.BytesSent != test.CompleteSize || completed.Outcome != "complete" {
+		t.Errorf("Unexpected completed event: %+v", completed)
+	}
+}
+
+func TestProxySendsWebhookNotifications(t *testing.T) {
+	const deadLetter = "/tmp/webhooks-deadletter.ndjson"
+	os.Remove(deadLetter)
+	type notification struct {
+		Event     string `json:"event"`
+		RequestID string `json:"request_id"`
+		Upstream  string `json:"upstream"`
+		Resumes   int64  `json:"resumes"`
+		Error     string `json:"error"`
+	}
+	notifications := make(chan notification, 100)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		notifications <- n
+	}))
+	defer receiver.Close()
+	expect := func(event string) notification {
+		t.Helper()
+		for {
+			select {
+			case n := <-notifications:
+				if n.Event == event {
+					return n
+				}
+			case <-time.After(30 * time.Second):
+				t.Fatalf("No %s notification received", event)
+			}
+		}
+	}
+	download := func(done chan<- error) {
+		resp, err := http.Get(fmt.Sprintf("%s/generate/%d", test.BaseURLProxy, test.CompleteSize))
+		if err == nil {
+			_, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		done <- err
+	}
+
+	test.CreateDataDir(t)
+	cmdBackend := test.StartBackendService(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10))
+	test.StartProxyService(t,
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs(
+			"-webhook", receiver.URL,
+			"-webhook", "circuit_open=http://127.0.0.1:1/unreachable",
+			"-webhookRetries", "1",
+			"-webhookResumes", "1",
+			"-webhookDeadLetter", deadLetter,
+			"-circuitThreshold", "1"))
+
+	// The upstream goes down and recovers during a download
+	done := make(chan error, 1)
+	go download(done)
+	time.Sleep(2 * time.Second)
+	cmdBackend.Process.Kill()
+	time.Sleep(2 * time.Second)
+	cmdBackend = test.StartBackendService(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10))
+	if err := <-done; err != nil {
+		t.Fatalf("Download failed after backend crash: %v", err)
+	}
+	if n := expect("circuit_open"); n.Upstream != test.BaseURLBackend || n.Error == "" {
+		t.Errorf("Unexpected circuit_open notification: %+v", n)
+	}
+	expect("circuit_closed")
+	if n := expect("completed_after_resumes"); n.RequestID == "" || n.Resumes != 1 {
+		t.Errorf("Unexpected completed_after_resumes notification: %+v", n)
+	}
+
+	// The content changes during a download
+	cmdBackend.Process.Kill()
+	cmdBackend = test.StartBackendService(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10),
+		test.WithBackendRandomEtag(true))
+	go download(done)
+	time.Sleep(2 * time.Second)
+	cmdBackend.Process.Kill()
+	time.Sleep(2 * time.Second)
+	test.StartBackendService(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithBackendRandomEtag(true))
+	if err := <-done; err == nil {
+		t.Fatalf("Expected the download to fail after the content changed")
+	}
+	if n := expect("content_changed"); n.RequestID == "" || n.Error == "" {
+		t.Errorf("Unexpected content_changed notification: %+v", n)
+	}
+
+	// The unreachable sink got its circuit_open notifications dead-lettered
+	content, err := os.ReadFile(deadLetter)
+	if err != nil {
+		t.Fatalf("Failed to read dead-letter file: %v", err)
+	}
+	var entry struct {
+		URL          string       `json:"url"`
+		Notification notification `json:"notification"`
+	}
+	line, _, _ := strings.Cut(string(content), "\n")
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("Failed to parse dead-letter entry %q: %v", content, err)
+	}
+	if entry.URL != "http://127.0.0.1:1/unreachable" || entry.Notification.Event != "circuit_open" {
+		t.Errorf("Unexpected dead-letter entry: %+v", entry)
+	}
+}
+
+func TestProxyReportsHealthAndReadiness(t *testing.T) {
+	test.CreateDataDir(t)
+	cmdBackend := test.StartBackendService(t, test.WithBackendLogFile("/tmp/backend.log"))
+	test.StartProxyService(t,
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", fmt.Sprintf("%d", test.AdminPort), "-adminToken", "secret", "-circuitThreshold", "1"))
+
+	// No token is needed for the orchestrator endpoints
+	get := func(path string) (int, map[string]any) {
+		t.Helper()
+		resp, err := http.Get(test.BaseURLAdmin + path)
+		if err != nil {
+			t.Fatalf("Failed to fetch %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		var body map[string]any
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("Expected status code 200 from /healthz, got %d", code)
+	}
+	if code, body := get("/version"); code != http.StatusOK || body["version"] == "" || body["go_version"] == "" {
+		t.Fatalf("Unexpected /version response %d: %v", code, body)
+	}
+	if code, body := get("/readyz"); code != http.StatusOK || body["ready"] != true {
+		t.Fatalf("Expected to be ready, got %d: %v", code, body)
+	}
+	if code, _ := get("/metrics"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code 401 from /metrics without token, got %d", code)
+	}
+
+	// A failed upstream request opens the circuit
+	cmdBackend.Process.Kill()
+	done := make(chan error, 1)
+	go func() {
+		done <- test.FetchData(test.BaseURLProxy, test.BlockSize, test.CompleteFile)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || body["ready"] != false {
+		t.Fatalf("Expected not to be ready with the backend down, got %d: %v", code, body)
+	}
+
+	// The retried request closes it again once the backend is back
+	test.StartBackendService(t, test.WithBackendLogFile("/tmp/backend.log"))
+	if err := <-done; err != nil {
+		t.Fatalf("Download failed after the backend came back: %v", err)
+	}
+	if code, body := get("/readyz"); code != http.StatusOK || body["ready"] != true {
+		t.Fatalf("Expected to be ready again, got %d: %v", code, body)
+	}
+}
+
+func TestProxyRoutesRequestsByHostAndPath(t *testing.T) {
+	const routesFile = "/tmp/routes.json"
+	routes := fmt.Sprintf(`{"routes": [
+		{"name": "files", "path_prefix": "/files/", "strip_prefix": "/files", "add_prefix": "/generate",
+		 "upstreams": [%[1]q], "request_headers": {"set": {"X-Route-Test": "files"}}},
+		{"name": "blobs", "path_regex": "^/blob/[0-9]+$", "strip_prefix": "/blob", "add_prefix": "/generate",
+		 "upstreams": [%[1]q], "response_headers": {"set": {"X-Route": "blobs"}, "remove": ["ETag"]}},
+		{"name": "host", "host": "gen.example", "upstreams": [%[1]q], "response_headers": {"set": {"X-Route": "host"}}},
+		{"name": "failover", "path_prefix": "/failover/", "strip_prefix": "/failover", "add_prefix": "/generate",
+		 "upstreams": ["http://127.0.0.1:1", %[1]q], "retry": {"max_retries": 3, "delay": "100ms", "max_delay": "1s"}}
+	]}`, test.BaseURLBackend)
+	if err := os.WriteFile(routesFile, []byte(routes), 0644); err != nil {
+		t.Fatalf("Failed to write routes: %v", err)
+	}
+	test.CreateDataDir(t)
+	test.StartBackendService(t, test.WithBackendLogFile("/tmp/backend.log"))
+	test.StartProxyService(t,
+		test.WithProxyUpstream(""),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-routes", routesFile, "-circuitThreshold", "1"))
+
+	fetch := func(host, path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", test.BaseURLProxy+path, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to fetch %s%s: %v", host, path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Failed to read %s%s: %v", host, path, err)
+		}
+		if resp.StatusCode == http.StatusOK && len(body) != 1000 {
+			t.Errorf("Expected 1000 bytes from %s%s, got %d", host, path, len(body))
+		}
+		return resp
+	}
+
+	if resp := fetch("localhost", "/files/1000"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code 200 for the files route, got %d", resp.StatusCode)
+	}
+	backendLog, err := os.ReadFile("/tmp/backend.log")
+	if err != nil {
+		t.Fatalf("Failed to read backend log: %v", err)
+	}
+	if !strings.Contains(string(backendLog), "X-Route-Test: [files]") {
+		t.Errorf("Expected the request header rule to reach the backend")
+	}
+
+	resp := fetch("localhost", "/blob/1000")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Route") != "blobs" || resp.Header.Get("ETag") != "" {
+		t.Errorf("Unexpected response for the blobs route: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// The host route takes precedence over the path routes
+	resp = fetch("gen.example:3000", "/generate/1000")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Route") != "host" {
+		t.Errorf("Unexpected response for the host route: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// The first upstream is down, so the route fails over to the second
+	if resp := fetch("localhost", "/failover/1000"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code 200 for the failover route, got %d", resp.StatusCode)
+	}
+
+	if resp := fetch("localhost", "/generate/1000"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status code 404 without a matching route, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxyServesForwardProxyRequests(t *testing.T) {
+	test.CreateDataDir(t)
+	cmdBackend := test.StartBackendService(t,
+		test.WithBackendLogFile("/tmp/backend.log"),
+		test.WithBackendWaitEveryNElements(test.CompleteSize/10))
+	test.StartProxyService(t,
+		test.WithProxyUpstream(""),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-forward", "-forwardAllowPrivate", "-forwardDeny", "localhost",
+			"-forwardConnectPorts", "443,"+strconv.Itoa(test.BackendPort),
+			"-adminPort", strconv.Itoa(test.AdminPort), "-circuitThreshold", "1"))
+
+	proxyURL, _ := url.Parse(test.BaseURLProxy)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// An absolute-form request resumes like any other after the backend crashes
+	done := make(chan []byte, 1)
+	go func() {
+		resp, err := client.Get(fmt.Sprintf("%s/generate/%d?via=forward", test.BaseURLBackend, test.CompleteSize))
+		if err != nil {
+			t.Errorf("Forward request failed: %v", err)
+			done <- nil
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("Failed to read forward response: %v", err)
+		}
+		done <- body
+	}()
+	time.Sleep(2 * time.Second)
+	cmdBackend.Process.Kill()
+	time.Sleep(3 * time.Second)
+	test.StartBackendService(t, test.WithBackendLogFile("/tmp/backend.log"))
+	select {
+	case body := <-done:
+		if len(body) != test.CompleteSize {
+			t.Errorf("Expected %d bytes through the forward proxy, got %d", test.CompleteSize, len(body))
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("Forward request timed out after the backend crash")
+	}
+	proxyLog, err := os.ReadFile("/tmp/proxy.log")
+	if err != nil {
+		t.Fatalf("Failed to read proxy log: %v", err)
+	}
+	if !strings.Contains(string(proxyLog), "/generate/"+strconv.Itoa(test.CompleteSize)+"?[REDACTED]") {
+		t.Errorf("Expected the query string to be forwarded upstream and redacted in the log")
+	}
+	// Destinations are not tracked like configured upstreams
+	metrics, err := http.Get(test.BaseURLAdmin + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	exposition, _ := io.ReadAll(metrics.Body)
+	metrics.Body.Close()
+	if strings.Contains(string(exposition), "resilientproxy_upstream_circuit_open{") {
+		t.Errorf("Expected no circuit for forward-proxy destinations")
+	}
+
+	// Denied destinations are refused
+	resp, err := client.Get(strings.Replace(test.BaseURLBackend, "127.0.0.1", "localhost", 1) + "/generate/1000")
+	if err != nil {
+		t.Fatalf("Forward request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status code 403 for a denied destination, got %d", resp.StatusCode)
+	}
+
+	// Only http and https are forwarded
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET ftp://%[1]s/generate/1000 HTTP/1.1\r\nHost: %[1]s\r\n\r\n", strings.TrimPrefix(test.BaseURLBackend, "http://"))
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status code 400 for an ftp URI, got %d", resp.StatusCode)
+	}
+
+	// So are redirects to them
+	redirecting := httptest.NewServer(http.RedirectHandler(strings.Replace(test.BaseURLBackend, "127.0.0.1", "localhost", 1)+"/generate/1000", http.StatusFound))
+	defer redirecting.Close()
+	resp, err = client.Get(redirecting.URL + "/content")
+	if err != nil {
+		t.Fatalf("Forward request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected status code 502 for a redirect to a denied destination, got %d", resp.StatusCode)
+	}
+
+	// A CONNECT tunnel passes bytes through unmodified
+	conn, err = net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	backend := strings.TrimPrefix(test.BaseURLBackend, "http://")
+	fmt.Fprintf(conn, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", backend)
+	reader := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code 200 for CONNECT, got %d", resp.StatusCode)
+	}
+	fmt.Fprintf(conn, "GET /generate/1000 HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", backend)
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response through the tunnel: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || len(body) != 1000 {
+		t.Errorf("Unexpected response through the tunnel: %d, %d bytes, %v", resp.StatusCode, len(body), err)
+	}
+
+	// Only to the allowed ports
+	conn, err = net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT 127.0.0.1:25 HTTP/1.1\r\nHost: 127.0.0.1:25\r\n\r\n")
+	resp, err = http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status code 403 for CONNECT to a port not allowed, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxyRefusesForwardRequestsToPrivateAddresses(t *testing.T) {
+	test.StartBackendService(t, test.WithBackendLogFile("/tmp/backend.log"))
+	test.StartProxyService(t,
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-forward"))
+
+	proxyURL, _ := url.Parse(test.BaseURLProxy)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(test.BaseURLBackend + "/generate/1000")
+	if err != nil {
+		t.Fatalf("Forward request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status code 403 for a loopback destination, got %d", resp.StatusCode)
+	}
+
+	conn, err := net.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT 169.254.169.254:443 HTTP/1.1\r\nHost: 169.254.169.254:443\r\n\r\n")
+	resp, err = http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status code 403 for CONNECT to a link-local address, got %d", resp.StatusCode)
+	}
+
+	// Requests in origin form still use the routes
+	resp, err = http.Get(test.BaseURLProxy + "/generate/1000")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code 200 for a routed request, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxyInterceptsHTTPSTunnels(t *testing.T) {
+	// A local CA the client trusts
+	const caFile, caKeyFile = "/tmp/mitm-ca.pem", "/tmp/mitm-ca-key.pem"
+	ca, _ := issueTestCertificate(t, "resilientproxy test CA", nil, nil, caFile, caKeyFile)
+
+	// An HTTPS origin with a certificate from a CA the proxy is told to
+	// trust, which cuts off the first full download halfway
+	const originCAFile, originCAKeyFile, originCertFile, originKeyFile = "/tmp/origin-ca.pem", "/tmp/origin-ca-key.pem", "/tmp/origin.pem", "/tmp/origin-key.pem"
+	originCA, originCAKey := issueTestCertificate(t, "resilientproxy test origin CA", nil, nil, originCAFile, originCAKeyFile)
+	issueTestCertificate(t, "localhost", originCA, originCAKey, originCertFile, originKeyFile)
+	originCert, err := tls.LoadX509KeyPair(originCertFile, originKeyFile)
+	if err != nil {
+		t.Fatalf("Failed to load origin certificate: %v", err)
+	}
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	var truncated atomic.Bool
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.Header.Get("Range") == "" && truncated.CompareAndSwap(false, true) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("ETag", `"content"`)
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set("ETag", `"content"`)
+		http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	origin.TLS = &tls.Config{Certificates: []tls.Certificate{originCert}}
+	origin.StartTLS()
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(origin.URL, "https://"))
+
+	// An origin with a certificate from a CA nobody trusts
+	const untrustedCAFile, untrustedCAKeyFile = "/tmp/untrusted-ca.pem", "/tmp/untrusted-ca-key.pem"
+	untrustedCA, untrustedCAKey := issueTestCertificate(t, "untrusted CA", nil, nil, untrustedCAFile, untrustedCAKeyFile)
+	issueTestCertificate(t, "localhost", untrustedCA, untrustedCAKey, originCertFile, originKeyFile)
+	untrustedCert, _ := tls.LoadX509KeyPair(originCertFile, originKeyFile)
+	untrusted := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected no request to reach an origin with an untrusted certificate")
+	}))
+	untrusted.TLS = &tls.Config{Certificates: []tls.Certificate{untrustedCert}}
+	untrusted.StartTLS()
+	defer untrusted.Close()
+	_, untrustedPort, _ := net.SplitHostPort(strings.TrimPrefix(untrusted.URL, "https://"))
+
+	test.StartProxyService(t,
+		test.WithProxyUpstream(""),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-forward", "-forwardAllowPrivate", "-forwardConnectPorts", port+","+untrustedPort, "-upstreamCA", originCAFile,
+			"-mitmCA", caFile, "-mitmKey", caKeyFile, "-mitmHosts", "localhost"))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	roots.AddCert(originCA)
+	proxyURL, _ := url.Parse(test.BaseURLProxy)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	// Tunnels to intercepted hosts are served by the proxy, which resumes them
+	resp, err := client.Get("https://localhost:" + port + "/content")
+	if err != nil {
+		t.Fatalf("Intercepted request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(body, content) {
+		t.Errorf("Expected the complete content through the intercepted tunnel, got %d bytes, %v", len(body), err)
+	}
+	if issuer := resp.TLS.PeerCertificates[0].Issuer.CommonName; issuer != ca.Subject.CommonName {
+		t.Errorf("Expected a certificate issued by the local CA, got one by %q", issuer)
+	}
+	if !truncated.Load() {
+		t.Errorf("Expected the origin to cut off the first download")
+	}
+
+	// An intercepted origin is verified, since the client cannot do it
+	resp, err = client.Get("https://localhost:" + untrustedPort + "/content")
+	if err != nil {
+		t.Fatalf("Intercepted request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected status code 502 for an origin with an untrusted certificate, got %d", resp.StatusCode)
+	}
+
+	// Other tunnels are passed through
+	resp, err = client.Get("https://127.0.0.1:" + port + "/content")
+	if err != nil {
+		t.Fatalf("Tunnelled request failed: %v", err)
+	}
+	resp.Body.Close()
+	if issuer := resp.TLS.PeerCertificates[0].Issuer.CommonName; issuer == ca.Subject.CommonName {
+		t.Errorf("Expected the origin's own certificate for a host that is not intercepted")
+	}
+}
+
+func TestProxySendsUpstreamRequestsThroughEgressProxy(t *testing.T) {
+	var proxied atomic.Int32
+	var authorization atomic.Value
+	egress := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() {
+			http.Error(w, "Expected an absolute-form request", http.StatusBadRequest)
+			return
+		}
+		proxied.Add(1)
+		authorization.Store(r.Header.Get("Proxy-Authorization"))
+		out, err := http.NewRequest(r.Method, r.URL.String(), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out.Header = r.Header.Clone()
+		out.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(out)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer egress.Close()
+
+	test.StartBackendService(t, test.WithBackendLogFile("/tmp/backend.log"))
+	test.StartProxyService(t,
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-egressProxy", strings.Replace(egress.URL, "http://", "http://user:secret@", 1)))
+
+	resp, err := http.Get(test.BaseURLProxy + "/generate/1000")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || len(body) != 1000 {
+		t.Errorf("Unexpected response through the egress proxy: %d, %d bytes, %v", resp.StatusCode, len(body), err)
+	}
+	if proxied.Load() == 0 {
+		t.Errorf("Expected the upstream requests to go through the egress proxy")
+	}
+	if got, _ := authorization.Load().(string); got != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("Expected the proxy credentials to be sent, got Proxy-Authorization %q", got)
+	}
+	proxyLog, err := os.ReadFile("/tmp/proxy.log")
+	if err != nil {
+		t.Fatalf("Failed to read proxy log: %v", err)
+	}
+	if strings.Contains(string(proxyLog), "secret") {
+		t.Errorf("Expected the proxy password to be redacted in the log")
+	}
+}
+
+// issueTestCertificate creates a certificate for name signed by parent, or a
+// CA certificate if parent is nil, and writes it and its key as PEM files.
+func issueTestCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certFile, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"resilientproxy"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	if parent == nil {
+		template.KeyUsage, template.ExtKeyUsage, template.IPAddresses, template.DNSNames = x509.KeyUsageCertSign, nil, nil, nil
+		template.BasicConstraintsValid, template.IsCA = true, true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return cert, key
+}
+
+func TestProxyAuthenticatesAndAuthorizesClients(t *testing.T) {
+	const routesFile, tokensFile, htpasswdFile, accessLog = "/tmp/routes.json", "/tmp/tokens", "/tmp/htpasswd", "/tmp/access.log"
+	routes := fmt.Sprintf(`{"routes": [
+		{"name": "private", "path_prefix": "/private/", "strip_prefix": "/private", "add_prefix": "/generate",
+		 "upstreams": [%[1]q], "allow": ["alice"]},
+		{"name": "shared", "upstreams": [%[1]q]}
+	]}`, test.BaseURLBackend)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	os.WriteFile(routesFile, []byte(routes), 0644)
+	os.WriteFile(tokensFile, []byte("ci:ci-token\n"), 0600)
+	os.WriteFile(htpasswdFile, []byte("alice:"+string(hash)+"\n"), 0600)
+	os.Remove(accessLog)
+
+	// The proxy serves HTTPS and accepts client certificates of its CA
+	ca, caKey := issueTestCertificate(t, "resilientproxy client CA", nil, nil, "/tmp/client-ca.pem", "/tmp/client-ca-key.pem")
+	issueTestCertificate(t, "127.0.0.1", ca, caKey, "/tmp/proxy-cert.pem", "/tmp/proxy-key.pem")
+	issueTestCertificate(t, "runner", ca, caKey, "/tmp/runner-cert.pem", "/tmp/runner-key.pem")
+	clientCert, err := tls.LoadX509KeyPair("/tmp/runner-cert.pem", "/tmp/runner-key.pem")
+	if err != nil {
+		t.Fatalf("Failed to load client certificate: %v", err)
+	}
+
+	test.StartBackendService(t, test.WithBackendLogFile("/tmp/backend.log"))
+	test.StartProxyService(t,
+		test.WithProxyUpstream(""),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-routes", routesFile, "-authTokens", tokensFile, "-htpasswd", htpasswdFile,
+			"-tlsCert", "/tmp/proxy-cert.pem", "-tlsKey", "/tmp/proxy-key.pem",
+			"-clientCA", "/tmp/client-ca.pem", "-clientSubject", "O=resilientproxy",
+			"-accessLog", accessLog, "-accessLogFormat", "json", "-adminPort", strconv.Itoa(test.AdminPort)))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	baseURL := strings.Replace(test.BaseURLProxy, "http://", "https://", 1)
+	fetch := func(path string, certificates []tls.Certificate, setAuth func(*http.Request)) *http.Response {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates}}}
+		req, err := http.NewRequest("GET", baseURL+path, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		if setAuth != nil {
+			setAuth(req)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to fetch %s: %v", path, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	resp := fetch("/generate/1000", nil, nil)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected 401 with a challenge without credentials, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp := fetch("/generate/1000", nil, bearer("wrong")); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown token, got %d", resp.StatusCode)
+	}
+	if resp := fetch("/generate/1000", nil, bearer("ci-token")); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for a valid token, got %d", resp.StatusCode)
+	}
+	if resp := fetch("/generate/1000", []tls.Certificate{clientCert}, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for a client certificate, got %d", resp.StatusCode)
+	}
+	if resp := fetch("/private/1000", nil, bearer("ci-token")); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for an identity the route does not allow, got %d", resp.StatusCode)
+	}
+	basic := func(req *http.Request) { req.SetBasicAuth("alice", "secret") }
+	if resp := fetch("/private/1000", nil, basic); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for an allowed identity, got %d", resp.StatusCode)
+	}
+
+	if got := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", `resilientproxy_authenticated_requests_total{identity="runner",route="shared"}`); got != 1 {
+		t.Errorf("Expected 1 request by runner in the metrics, got %v", got)
+	}
+	if got := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", `resilientproxy_auth_failures_total{reason="forbidden"}`); got != 1 {
+		t.Errorf("Expected 1 forbidden request in the metrics, got %v", got)
+	}
+	var users []string
+	deadline := time.Now().Add(5 * time.Second)
+	for len(users) < 6 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		content, _ := os.ReadFile(accessLog)
+		users = nil
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			var entry struct{ User string }
+			if json.Unmarshal([]byte(line), &entry) == nil {
+				users = append(users, entry.User)
+			}
+		}
+	}
+	if want := []string{"", "", "ci", "runner", "ci", "alice"}; fmt.Sprint(users) != fmt.Sprint(want) {
+		t.Errorf("Expected the identities %q in the access log, got %q", want, users)
+	}
+}
+
+func TestProxyRenewsUpstreamOAuth2TokenDuringResume(t *testing.T) {
+	var issued atomic.Int32
+	tokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "proxy" || secret != "client-secret" || r.FormValue("grant_type") != "client_credentials" {
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": 900}`, issued.Add(1))
+	}))
+	defer tokenEndpoint.Close()
+
+	// The upstream cuts off the first download and then revokes the first token
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	var truncated atomic.Bool
+	var authorizations sync.Map
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		authorizations.Store(authorization, true)
+		if authorization == "" || (authorization == "Bearer token-1" && truncated.Load()) {
+			http.Error(w, "token expired", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodGet && r.Header.Get("Range") == "" && truncated.CompareAndSwap(false, true) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("ETag", `"content"`)
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set("ETag", `"content"`)
+		http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer origin.Close()
+
+	const routesFile = "/tmp/routes.json"
+	routes := fmt.Sprintf(`{"routes": [{"name": "artifacts", "upstreams": [%q],
+		"credentials": {"type": "oauth2", "token_url": %q, "client_id": "proxy", "client_secret": "${TEST_CLIENT_SECRET}"}}]}`,
+		origin.URL, tokenEndpoint.URL)
+	os.WriteFile(routesFile, []byte(routes), 0644)
+	t.Setenv("TEST_CLIENT_SECRET", "client-secret")
+	test.StartProxyService(t,
+		test.WithProxyUpstream(""),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-routes", routesFile))
+
+	resp, err := http.Get(test.BaseURLProxy + "/content")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Errorf("Expected the complete content, got %d, %d bytes, %v", resp.StatusCode, len(body), err)
+	}
+	if !truncated.Load() {
+		t.Errorf("Expected the origin to cut off the first download")
+	}
+	if _, ok := authorizations.Load("Bearer token-2"); !ok || issued.Load() != 2 {
+		t.Errorf("Expected the proxy to renew the token after a 401, %d tokens issued", issued.Load())
+	}
+	if _, ok := authorizations.Load(""); ok {
+		t.Errorf("Expected every upstream request to carry a token")
+	}
+}
+
+func TestProxySignsUpstreamRequestsWithSigV4(t *testing.T) {
+	// The object store cuts off the first download and accepts only requests
+	// whose signature covers their range
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	var truncated atomic.Bool
+	var resumes atomic.Int32
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDTEST/") ||
+			!strings.Contains(authorization, "/eu-central-1/s3/aws4_request") ||
+			r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Security-Token") != "session" {
+			http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			if !strings.Contains(authorization, "SignedHeaders=host;range;x-amz-content-sha256;x-amz-date;x-amz-security-token,") {
+				http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+				return
+			}
+			resumes.Add(1)
+		}
+		w.Header().Set("ETag", `"content"`)
+		if r.Method == http.MethodGet && r.Header.Get("Range") == "" && truncated.CompareAndSwap(false, true) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		http.ServeContent(w, r, "object", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer store.Close()
+
+	const routesFile = "/tmp/routes.json"
+	routes := fmt.Sprintf(`{"routes": [{"name": "datasets", "upstreams": [%q],
+		"credentials": {"type": "aws-sigv4", "region": "eu-central-1"}}]}`, store.URL)
+	os.WriteFile(routesFile, []byte(routes), 0644)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+	test.StartProxyService(t,
+		test.WithProxyUpstream(""),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-routes", routesFile))
+
+	resp, err := http.Get(test.BaseURLProxy + "/bucket/dataset.bin")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Errorf("Expected the complete content, got %d, %d bytes, %v", resp.StatusCode, len(body), err)
+	}
+	if !truncated.Load() || resumes.Load() == 0 {
+		t.Errorf("Expected the proxy to resume with a signed range request")
+	}
+}
+
+func TestProxyResignsExpiredUpstreamURLs(t *testing.T) {
+	const script = "/tmp/resign.sh"
+	os.WriteFile(script, []byte("#!/bin/sh\necho \"${1%%\\?*}?signature=fresh\"\n"), 0755)
+	var callbackURL atomic.Value
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ URL string }
+		json.NewDecoder(r.Body).Decode(&body)
+		callbackURL.Store(body.URL)
+		expired, _ := url.Parse(body.URL)
+		expired.RawQuery = "signature=fresh"
+		fmt.Fprintf(w, `{"url": %q}`, expired.String())
+	}))
+	defer callback.Close()
+	// The callback goes through the egress proxy of the upstream requests
+	var callbackProxied atomic.Bool
+	egress := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == strings.TrimPrefix(callback.URL, "http://") {
+			callbackProxied.Store(true)
+		}
+		out, _ := http.NewRequest(r.Method, r.URL.String(), r.Body)
+		out.Header = r.Header.Clone()
+		resp, err := http.DefaultTransport.RoundTrip(out)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer egress.Close()
+
+	for _, hook := range [][]string{{"-resignCommand", script}, {"-resignURL", callback.URL, "-egressProxy", egress.URL}} {
+		t.Run(hook[0], func(t *testing.T) {
+			// The origin cuts off the first download, after which the
+			// original signature has expired
+			content := make([]byte, 1<<20)
+			rand.Read(content)
+			var truncated atomic.Bool
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				signature := r.URL.Query().Get("signature")
+				if signature != "fresh" && (signature != "original" || truncated.Load()) {
+					http.Error(w, "Request has expired", http.StatusForbidden)
+					return
+				}
+				w.Header().Set("ETag", `"content"`)
+				w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+				if r.Method == http.MethodGet && r.Header.Get("Range") == "" && truncated.CompareAndSwap(false, true) {
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+					w.Header().Set("Accept-Ranges", "bytes")
+					w.Write(content[:len(content)/2])
+					w.(http.Flusher).Flush()
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					conn.Close()
+					return
+				}
+				http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(content))
+			}))
+			defer origin.Close()
+
+			test.StartProxyService(t,
+				test.WithProxyUpstream(origin.URL),
+				test.WithProxyLogFile("/tmp/proxy.log"),
+				test.WithProxyArgs(append(hook, "-adminPort", strconv.Itoa(test.AdminPort))...))
+
+			resp, err := http.Get(test.BaseURLProxy + "/content?signature=original")
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+				t.Errorf("Expected the complete content, got %d, %d bytes, %v", resp.StatusCode, len(body), err)
+			}
+			if !truncated.Load() {
+				t.Errorf("Expected the origin to cut off the first download")
+			}
+			if got := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", "resilientproxy_resigned_urls_total"); got != 1 {
+				t.Errorf("Expected 1 re-signed URL, got %v", got)
+			}
+			if log, _ := os.ReadFile("/tmp/proxy.log"); bytes.Contains(log, []byte("signature=")) {
+				t.Errorf("Expected the signatures to be redacted from the log")
+			}
+		})
+	}
+	if got, _ := callbackURL.Load().(string); !strings.HasSuffix(got, "/content?signature=original") {
+		t.Errorf("Expected the callback to get the expired URL, got %q", got)
+	}
+	if !callbackProxied.Load() {
+		t.Errorf("Expected the callback to go through the egress proxy")
+	}
+}
+
+func TestProxyLimitsClientBandwidthAtRuntime(t *testing.T) {
+	content := make([]byte, 2<<20)
+	rand.Read(content)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer origin.Close()
+	test.StartProxyService(t,
+		test.WithProxyUpstream(origin.URL),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", strconv.Itoa(test.AdminPort), "-clientBandwidth", "262144", "-adminToken", "admin-token"))
+
+	started := time.Now()
+	resp, err := http.Get(test.BaseURLProxy + "/content")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	head := make([]byte, 768<<10)
+	if _, err := io.ReadFull(resp.Body, head); err != nil {
+		t.Fatalf("Reading the first bytes failed: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("Expected 768 KiB at 256 KiB/s to take over a second, took %v", elapsed)
+	}
+
+	// Lifting the limit speeds up the running transfer
+	req, _ := http.NewRequest("PUT", test.BaseURLAdmin+"/bandwidth", strings.NewReader(`{"per_client": 0, "global": 104857600}`))
+	req.Header.Set("Authorization", "Bearer admin-token")
+	limitResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Changing the bandwidth limits failed: %v", err)
+	}
+	var limits struct {
+		Global    int64 `json:"global"`
+		PerClient int64 `json:"per_client"`
+	}
+	json.NewDecoder(limitResp.Body).Decode(&limits)
+	limitResp.Body.Close()
+	if limitResp.StatusCode != http.StatusOK || limits.Global != 104857600 || limits.PerClient != 0 {
+		t.Errorf("Expected the new limits, got %d %+v", limitResp.StatusCode, limits)
+	}
+	started = time.Now()
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil || !bytes.Equal(append(head, rest...), content) {
+		t.Errorf("Expected the complete content, got %d bytes, %v", len(head)+len(rest), err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("Expected the rest to arrive quickly after lifting the limit, took %v", elapsed)
+	}
+	if waited := test.FetchMetricWithToken(t, test.BaseURLAdmin+"/metrics", "admin-token", `resilientproxy_bandwidth_wait_seconds_total{direction="client"}`); waited <= 0 {
+		t.Errorf("Expected the time waited for bandwidth to be counted, got %v", waited)
+	}
+}
+
+func TestProxyLimitsClientBandwidthOfDetachedDownloads(t *testing.T) {
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer origin.Close()
+	test.CreateDataDir(t)
+	test.StartProxyService(t,
+		test.WithProxyUpstream(origin.URL),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-clientBandwidth", "262144", "-detached", "/", "-cacheDir", test.DataDir+"/cache"))
+
+	// Served from the local copy, the response is still held to the limit
+	started := time.Now()
+	resp, err := http.Get(test.BaseURLProxy + "/content")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(body, content) {
+		t.Errorf("Expected the complete content, got %d bytes, %v", len(body), err)
+	}
+	if elapsed := time.Since(started); elapsed < 2*time.Second {
+		t.Errorf("Expected 1 MiB at 256 KiB/s to take over two seconds, took %v", elapsed)
+	}
+}
+
+func TestProxyQueuesAndRefusesRequestsOverTheLimit(t *testing.T) {
+	release := make(chan struct{})
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		http.ServeContent(w, r, "content", time.Unix(0, 0), strings.NewReader("content"))
+	}))
+	defer origin.Close()
+	test.StartProxyService(t,
+		test.WithProxyUpstream(origin.URL),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", strconv.Itoa(test.AdminPort), "-maxRequests", "1", "-maxQueue", "1", "-retryAfter", "7s"))
+
+	results := make(chan error, 2)
+	get := func() {
+		resp, err := http.Get(test.BaseURLProxy + "/content")
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "content" {
+				err = fmt.Errorf("unexpected response %d %q", resp.StatusCode, body)
+			}
+		}
+		results <- err
+	}
+	go get()
+	for requests.Load() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	go get()
+	deadline := time.Now().Add(5 * time.Second)
+	for test.FetchMetric(t, test.BaseURLAdmin+"/metrics", "resilientproxy_queued_requests") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the second request to wait in the queue")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The queue is full, so a third request is refused
+	resp, err := http.Get(test.BaseURLProxy + "/content")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "7" {
+		t.Errorf("Expected 503 with Retry-After: 7, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if requests.Load() != 1 {
+		t.Errorf("Expected only the first request to reach the upstream, got %d", requests.Load())
+	}
+
+	close(release)
+	for range 2 {
+		if err := <-results; err != nil {
+			t.Errorf("Expected the admitted and the queued request to complete, got %v", err)
+		}
+	}
+	if rejected := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", `resilientproxy_rejected_requests_total{reason="queue_full"}`); rejected != 1 {
+		t.Errorf("Expected one refused request to be counted, got %v", rejected)
+	}
+}
+
+func TestProxyReusesUpstreamConnections(t *testing.T) {
+	var conns atomic.Int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "content", time.Unix(0, 0), strings.NewReader("content"))
+	}))
+	origin.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+	test.StartProxyService(t,
+		test.WithProxyUpstream(origin.URL),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-maxUpstreamConns", "1"))
+
+	for range 20 {
+		resp, err := http.Get(test.BaseURLProxy + "/content")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "content" {
+			t.Fatalf("Unexpected response %d %q", resp.StatusCode, body)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("Expected 20 requests over one upstream connection, got %d connections", n)
+	}
+}
+
+func TestProxyKeepsTransferBuffersWithinTheMemoryBudget(t *testing.T) {
+	release := make(chan struct{})
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		http.ServeContent(w, r, "content", time.Unix(0, 0), strings.NewReader("content"))
+	}))
+	defer origin.Close()
+	test.StartProxyService(t,
+		test.WithProxyUpstream(origin.URL),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", strconv.Itoa(test.AdminPort), "-bufferSize", "65536", "-memoryBudget", "100000"))
+
+	results := make(chan error, 2)
+	get := func() {
+		resp, err := http.Get(test.BaseURLProxy + "/content")
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "content" {
+				err = fmt.Errorf("unexpected response %d %q", resp.StatusCode, body)
+			}
+		}
+		results <- err
+	}
+	go get()
+	deadline := time.Now().Add(5 * time.Second)
+	for requests.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the first transfer to reach the upstream")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The budget holds one buffer, so the second transfer waits for it
+	go get()
+	deadline = time.Now().Add(5 * time.Second)
+	for test.FetchMetric(t, test.BaseURLAdmin+"/metrics", "resilientproxy_transfers_waiting_for_memory") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a transfer to wait for the memory budget")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if inUse := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", "resilientproxy_buffer_bytes_in_use"); inUse != 65536 {
+		t.Errorf("Expected one buffer in use, got %v bytes", inUse)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("Expected the waiting transfer not to contact the upstream yet, got %d requests", requests.Load())
+	}
+
+	close(release)
+	for range 2 {
+		if err := <-results; err != nil {
+			t.Errorf("Expected both transfers to complete, got %v", err)
+		}
+	}
+}
+
+func TestProxyResumesOnTheFastPath(t *testing.T) {
+	// The origin cuts off the first download halfway
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	var truncated atomic.Bool
+	var resumeRange atomic.Value
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"content"`)
+		if r.Header.Get("Range") == "" && truncated.CompareAndSwap(false, true) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		resumeRange.Store(r.Header.Get("Range"))
+		http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer origin.Close()
+	test.StartProxyService(t,
+		test.WithProxyUpstream(origin.URL),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-fastPath"))
+
+	resp, err := http.Get(test.BaseURLProxy + "/content")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Errorf("Expected the complete content, got %d, %d bytes, %v", resp.StatusCode, len(body), err)
+	}
+	if got, want := resumeRange.Load(), fmt.Sprintf("bytes=%d-", len(content)/2); got != want {
+		t.Errorf("Expected the resume to start right after the bytes sent, %q, got %v", want, got)
+	}
+}
+
+func TestProxyResumesUpstreamResponsesEndingShort(t *testing.T) {
+	// The origin announces the whole content but cleanly ends the first
+	// chunked response halfway
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	var shortened atomic.Bool
+	var resumeRange atomic.Value
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"content"`)
+		w.Header().Set("Accept-Ranges", "bytes")
+		if r.Method == http.MethodGet && r.Header.Get("Range") == "bytes=0-" && shortened.CompareAndSwap(false, true) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(content[:len(content)/2])
+			return
+		}
+		if r.Method == http.MethodGet {
+			resumeRange.Store(r.Header.Get("Range"))
+		}
+		http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer origin.Close()
+	test.StartProxyService(t,
+		test.WithProxyUpstream(origin.URL),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", strconv.Itoa(test.AdminPort)))
+
+	req, _ := http.NewRequest("GET", test.BaseURLProxy+"/content", nil)
+	req.Header.Set("Range", "bytes=0-")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content) {
+		t.Errorf("Expected the complete content, got %d, %d bytes, %v", resp.StatusCode, len(body), err)
+	}
+	if got, want := resumeRange.Load(), fmt.Sprintf("bytes=%d-", len(content)/2); got != want {
+		t.Errorf("Expected a resume with %q, got %v", want, got)
+	}
+	if short := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", "resilientproxy_short_upstream_responses_total"); short != 1 {
+		t.Errorf("Expected one short upstream response to be counted, got %v", short)
+	}
+}
+
+func TestProxyServesSuffixRangesWithoutResuming(t *testing.T) {
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	var gets atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"content"`)
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(content))
+	}))
+	defer origin.Close()
+	test.StartProxyService(t,
+		test.WithProxyUpstream(origin.URL),
+		test.WithProxyLogFile("/tmp/proxy.log"),
+		test.WithProxyArgs("-adminPort", strconv.Itoa(test.AdminPort)))
+
+	req, _ := http.NewRequest("GET", test.BaseURLProxy+"/content", nil)
+	req.Header.Set("Range", "bytes=-1000")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[len(content)-1000:]) {
+		t.Errorf("Expected the last 1000 bytes, got %d, %d bytes, %v", resp.StatusCode, len(body), err)
+	}
+	if n := gets.Load(); n != 1 {
+		t.Errorf("Expected a single upstream GET, got %d", n)
+	}
+	if short := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", "resilientproxy_short_upstream_responses_total"); short != 0 {
+		t.Errorf("Expected no short upstream response, got %v", short)
+	}
+}
+
+func TestProxyClosesTheConnectionOfTruncatedResponses(t *testing.T) {
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	start := func(t *testing.T, resume http.HandlerFunc) {
+		var truncated atomic.Bool
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"content"`)
+			if r.Header.Get("Range") == "" && truncated.CompareAndSwap(false, true) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Write(content[:len(content)/2])
+				w.(http.Flusher).Flush()
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			resume(w, r)
+		}))
+		t.Cleanup(origin.Close)
+		const routesFile = "/tmp/routes.json"
+		routes := fmt.Sprintf(`{"routes": [{"name": "default", "upstreams": [%q],
+			"retry": {"max_retries": 2, "delay": "10ms", "max_delay": "10ms"}}]}`, origin.URL)
+		os.WriteFile(routesFile, []byte(routes), 0644)
+		test.StartProxyService(t,
+			test.WithProxyUpstream(""),
+			test.WithProxyLogFile("/tmp/proxy.log"),
+			test.WithProxyArgs("-routes", routesFile, "-adminPort", strconv.Itoa(test.AdminPort)))
+	}
+	get := func(t *testing.T) []byte {
+		resp, err := http.Get(test.BaseURLProxy + "/content")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err == nil {
+			t.Errorf("Expected the client to see the response cut off, got %d bytes", len(body))
+		}
+		return body
+	}
+
+	t.Run("size changed", func(t *testing.T) {
+		grown := append(bytes.Clone(content), make([]byte, 1000)...)
+		start(t, func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "content", time.Unix(0, 0), bytes.NewReader(grown))
+		})
+		if body := get(t); len(body) != len(content)/2 {
+			t.Errorf("Expected nothing after the size changed, got %d bytes", len(body))
+		}
+		if changed := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", "resilientproxy_content_changed_total"); changed != 1 {
+			t.Errorf("Expected the size change to count as a content change, got %v", changed)
+		}
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		start(t, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		})
+		if body := get(t); !bytes.Equal(body, content[:len(body)]) {
+			t.Errorf("Expected no error page in the body")
+		}
+		if exhausted := test.FetchMetric(t, test.BaseURLAdmin+"/metrics", "resilientproxy_retries_exhausted_total"); exhausted != 1 {
+			t.Errorf("Expected the retries to be exhausted, got %v", exhausted)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package test
 
 import (
+	"bufio"
 	"crypto/sha1"
 	"fmt"
 	"io"
@@ -111,6 +112,7 @@ func StartProxyService(t *testing.T, opts ...ProxyOption) *exec.Cmd {
 	t.Cleanup(func() {
 		if cmd != nil && cmd.Process != nil {
 			cmd.Process.Kill()
+			cmd.Wait() // Free the port before the next test starts a server
 		}
 	})
 
@@ -180,6 +182,7 @@ func StartBackendService(t *testing.T, opts ...BackendOption) *exec.Cmd {
 	t.Cleanup(func() {
 		if cmd != nil && cmd.Process != nil {
 			cmd.Process.Kill()
+			cmd.Wait() // Free the port before the next test starts a server
 		}
 	})
 
@@ -309,3 +312,45 @@ func FetchData(baseUrl string, size int, outputFile string) error {
 	cmd := exec.Command("curl", fmt.Sprintf("%s/generate/%d", baseUrl, size), "-o", outputFile)
 	return cmd.Run()
 }
+
+// FetchMetric returns the value of a series such as
+// `name{label="value"}` from a Prometheus text endpoint, or 0 if absent.
+func FetchMetric(t *testing.T, url string, series string) float64 {
+	t.Helper()
+	return FetchMetricWithToken(t, url, "", series)
+}
+
+// FetchMetricWithToken is FetchMetric for an admin listener requiring the
+// bearer token; an empty token sends none.
+func FetchMetricWithToken(t *testing.T, url, token, series string) float64 {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request for %s: %v", url, err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), series+" ")
+		if !found {
+			continue
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("Invalid value for %s: %v", series, err)
+		}
+		return f
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Failed to read %s: %v", url, err)
+	}
+	return 0
+}